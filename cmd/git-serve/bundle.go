@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/peterbourgon/ff/v3"
+	"github.com/peterbourgon/ff/v3/ffcli"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+	"github.com/cirocosta/git-serve/pkg/server"
+)
+
+var (
+	exportFlagSet = flag.NewFlagSet("git-serve export", flag.ExitOnError)
+
+	exportDataDirectory = exportFlagSet.String(
+		"data-dir", server.HTTPDefaultDataDirectory,
+		"directory where repositories are stored",
+	)
+
+	exportGit = exportFlagSet.String(
+		"git", server.HTTPDefaultGitExecutableFilepath,
+		"absolute path to git executable",
+	)
+
+	exportOutput = exportFlagSet.String(
+		"output", "",
+		"directory to write the bundles and manifest to (required)",
+	)
+
+	importFlagSet = flag.NewFlagSet("git-serve import", flag.ExitOnError)
+
+	importDataDirectory = importFlagSet.String(
+		"data-dir", server.HTTPDefaultDataDirectory,
+		"directory to restore the repositories into",
+	)
+
+	importGit = importFlagSet.String(
+		"git", server.HTTPDefaultGitExecutableFilepath,
+		"absolute path to git executable",
+	)
+
+	importInput = importFlagSet.String(
+		"input", "",
+		"directory with the bundles and manifest written by "+
+			"`git-serve export` (required)",
+	)
+
+	importHooksDir = importFlagSet.String(
+		"hooks-dir", "",
+		"path to directory with hooks to install into imported repositories",
+	)
+)
+
+func exportCommand() *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "export",
+		ShortUsage: "git-serve export -output <dir> [flags]",
+		ShortHelp:  "write a bundle of every repository, plus a manifest, to a directory",
+		FlagSet:    exportFlagSet,
+		Options:    []ff.Option{ff.WithEnvVarPrefix("GIT_SERVE")},
+		Exec:       export,
+	}
+}
+
+func importCommand() *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "import",
+		ShortUsage: "git-serve import -input <dir> [flags]",
+		ShortHelp:  "restore repositories from the bundles written by `git-serve export`",
+		FlagSet:    importFlagSet,
+		Options:    []ff.Option{ff.WithEnvVarPrefix("GIT_SERVE")},
+		Exec:       importRepositories,
+	}
+}
+
+func export(ctx context.Context, args []string) error {
+	if *exportOutput == "" {
+		return fmt.Errorf("-output must be provided")
+	}
+
+	if err := os.MkdirAll(*exportOutput, 0755); err != nil {
+		return fmt.Errorf("mkdir '%s': %w", *exportOutput, err)
+	}
+
+	ctx = log.WithLogger(ctx, log.From(ctx).WithField("component", "export"))
+	manifest, err := server.ExportRepositories(ctx, *exportGit, *exportDataDirectory, *exportOutput)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+
+	log.From(ctx).WithFields(log.Fields{
+		"output":       *exportOutput,
+		"repositories": len(manifest.Repositories),
+	}).Info("done")
+
+	return nil
+}
+
+func importRepositories(ctx context.Context, args []string) error {
+	if *importInput == "" {
+		return fmt.Errorf("-input must be provided")
+	}
+
+	var hooks *server.Hooks
+	if *importHooksDir != "" {
+		hooks = &server.Hooks{Directory: *importHooksDir}
+	}
+
+	manifest, err := server.LoadBundleManifest(*importInput)
+	if err != nil {
+		return fmt.Errorf("load manifest: %w", err)
+	}
+
+	ctx = log.WithLogger(ctx, log.From(ctx).WithField("component", "import"))
+	if err := server.ImportRepositories(ctx,
+		*importGit, *importInput, *importDataDirectory, manifest, hooks,
+	); err != nil {
+		return fmt.Errorf("import: %w", err)
+	}
+
+	log.From(ctx).WithFields(log.Fields{
+		"data-dir":     *importDataDirectory,
+		"repositories": len(manifest.Repositories),
+	}).Info("done")
+
+	return nil
+}
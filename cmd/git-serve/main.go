@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"sync"
 
 	"github.com/peterbourgon/ff/v3"
+	"github.com/peterbourgon/ff/v3/ffcli"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/cirocosta/git-serve/pkg"
@@ -24,6 +27,12 @@ var (
 		"address to bind the http server to",
 	)
 
+	httpTokens = cmdFlagSet.String(
+		"http-tokens", "",
+		"path to file with access tokens to authenticate against "+
+			"(managed with `git-serve token`)",
+	)
+
 	httpUsername = cmdFlagSet.String(
 		"http-username", "admin",
 		"username",
@@ -34,11 +43,86 @@ var (
 		"password",
 	)
 
+	httpCredentials = cmdFlagSet.String(
+		"http-credentials", "",
+		"path to htpasswd-compatible file (bcrypt, sha, or plain text "+
+			"passwords) to authenticate against (takes precedence over "+
+			"-http-username/-http-password)",
+	)
+
+	httpTLSCert = cmdFlagSet.String(
+		"http-tls-cert", "",
+		"path to pem-encoded certificate to serve http over tls with "+
+			"(reloaded on change)",
+	)
+
+	httpTLSKey = cmdFlagSet.String(
+		"http-tls-key", "",
+		"path to pem-encoded private key of -http-tls-cert",
+	)
+
+	httpTLSSelfSigned = cmdFlagSet.Bool(
+		"http-tls-self-signed", false,
+		"serve http over tls with a certificate self-signed at startup",
+	)
+
+	httpTLSClientCA = cmdFlagSet.String(
+		"http-tls-client-ca", "",
+		"path to pem-encoded CAs to verify client certificates against, "+
+			"authenticating clients as the certificate's common name",
+	)
+
+	httpTLSRequireClientCert = cmdFlagSet.Bool(
+		"http-tls-require-client-cert", false,
+		"reject clients that don't present a certificate signed by "+
+			"-http-tls-client-ca",
+	)
+
 	httpNoAuth = cmdFlagSet.Bool(
 		"http-no-auth", false,
 		"disable default use of basic auth for http",
 	)
 
+	hooksDir = cmdFlagSet.String(
+		"hooks-dir", "",
+		"directory with executables to install as server-side hooks "+
+			"(pre-receive, update, post-receive, etc) in every repository",
+	)
+
+	webhooks = cmdFlagSet.String(
+		"webhooks", "",
+		"path to yaml/json file with webhooks to notify of pushes",
+	)
+
+	mirrors = cmdFlagSet.String(
+		"mirrors", "",
+		"path to yaml/json file with repositories to keep as read-only "+
+			"mirrors of upstream ones",
+	)
+
+	pushMirrors = cmdFlagSet.String(
+		"push-mirrors", "",
+		"path to yaml/json file with remotes to replicate repositories to "+
+			"(with `git push --mirror`) whenever they're pushed to",
+	)
+
+	stateDirectory = cmdFlagSet.String(
+		"state-dir", "",
+		"directory where state (e.g., webhook deliveries) is persisted "+
+			"(default: kept in memory)",
+	)
+
+	authzPolicy = cmdFlagSet.String(
+		"authz-policy", "",
+		"path to yaml/json file mapping identities to the repositories "+
+			"they can read from or write to (default: allow all)",
+	)
+
+	autoCreate = cmdFlagSet.String(
+		"auto-create", string(server.AutoCreateAlways),
+		"when to create repositories that don't exist (never|on-push|always)",
+	)
+
 	dataDirectory = cmdFlagSet.String(
 		"data-dir", server.HTTPDefaultDataDirectory,
 		"directory where repositories will be stored",
@@ -49,6 +133,38 @@ var (
 		"absolute path to git executable",
 	)
 
+	backend = cmdFlagSet.String(
+		"backend", server.BackendExec,
+		"how git's services are run: by executing git ("+server.BackendExec+
+			") or in-process ("+server.BackendGoGit+", without hooks, "+
+			"mirrors, push mirrors, webhooks, nor -repositories)",
+	)
+
+	repositories = cmdFlagSet.String(
+		"repositories", "",
+		"path to yaml/json file declaring repositories to create (and "+
+			"seed) at startup if they don't exist (see `git-serve seed`)",
+	)
+
+	accessLog = cmdFlagSet.String(
+		"access-log", "",
+		"path to file to log every git operation to as json lines, or "+
+			server.AccessLogStdout+" for stdout (reopened on sighup) "+
+			"(default: disabled)",
+	)
+
+	metricsBindAddr = cmdFlagSet.String(
+		"metrics-bind-addr", "",
+		"address to bind the prometheus metrics server to (e.g., "+
+			server.MetricsDefaultBindAddr+") (default: disabled)",
+	)
+
+	shutdownTimeout = cmdFlagSet.Duration(
+		"shutdown-timeout", server.ShutdownDefaultTimeout,
+		"how long to wait for in-flight clones and pushes to finish on "+
+			"shutdown before terminating them",
+	)
+
 	sshBindAddr = cmdFlagSet.String(
 		"ssh-bind-addr", server.SSHDefaultBindAddress,
 		"address to bind the ssh server to",
@@ -76,16 +192,38 @@ var (
 )
 
 func main() {
-	if err := ff.Parse(
-		cmdFlagSet, os.Args[1:],
-		ff.WithEnvVarPrefix("GIT_SERVE_"),
-	); err != nil {
+	root := &ffcli.Command{
+		Name:       "git-serve",
+		ShortUsage: "git-serve [flags] [<subcommand> [flags]]",
+		ShortHelp:  "serve git repositories over http and ssh",
+		FlagSet:    cmdFlagSet,
+		Options:    []ff.Option{ff.WithEnvVarPrefix("GIT_SERVE")},
+		Subcommands: []*ffcli.Command{
+			exportCommand(),
+			importCommand(),
+			seedCommand(),
+			tokenCommand(),
+		},
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) > 0 {
+				return fmt.Errorf("unknown subcommand '%s'", args[0])
+			}
+
+			return exec(ctx)
+		},
+	}
+
+	if err := root.Parse(os.Args[1:]); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
 	ctx := pkg.SignalHandlingContext(context.Background())
-	if err := exec(ctx); err != nil {
+	if err := root.Run(ctx); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -96,38 +234,263 @@ func exec(ctx context.Context) error {
 		log.Verbose()
 	}
 
+	autoCreatePolicy, err := server.ParseAutoCreatePolicy(*autoCreate)
+	if err != nil {
+		return fmt.Errorf("parse auto-create: %w", err)
+	}
+
+	gitBackend, err := server.NewBackend(*backend, *git)
+	if err != nil {
+		return fmt.Errorf("new backend: %w", err)
+	}
+
+	if gitBackend.Name() == server.BackendGoGit {
+		// these still execute git, which the go-git backend is meant to
+		// do without.
+		//
+		for _, option := range [][2]string{
+			{"-hooks-dir", *hooksDir},
+			{"-mirrors", *mirrors},
+			{"-push-mirrors", *pushMirrors},
+			{"-repositories", *repositories},
+			{"-webhooks", *webhooks},
+		} {
+			if option[1] != "" {
+				return fmt.Errorf("%s is not supported by the %s backend",
+					option[0], server.BackendGoGit,
+				)
+			}
+		}
+	}
+
+	var hooks *server.Hooks
+	if *hooksDir != "" {
+		hooks = &server.Hooks{Directory: *hooksDir}
+
+		if err := hooks.InstallAll(ctx, *dataDirectory); err != nil {
+			return fmt.Errorf("install hooks: %w", err)
+		}
+	}
+
+	if *repositories != "" {
+		config, err := server.LoadRepositoriesConfig(*repositories)
+		if err != nil {
+			return fmt.Errorf("load repositories: %w", err)
+		}
+
+		ctx := log.WithLogger(ctx, log.From(ctx).
+			WithField("component", "seed"),
+		)
+
+		_, err = server.SeedRepositories(ctx, *git, *dataDirectory, config, hooks)
+		if err != nil {
+			return fmt.Errorf("seed repositories: %w", err)
+		}
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
 
+	// the components that the servers rely on (to log, notify, or mirror
+	// what they serve) keep running until both servers are done draining,
+	// so that operations finishing during the drain aren't left without
+	// their side effects.
+	//
+	componentsCtx, stopComponents := context.WithCancel(
+		log.WithLogger(context.Background(), log.From(ctx)),
+	)
+	defer stopComponents()
+
+	var servers sync.WaitGroup
+	servers.Add(2)
+	go func() {
+		servers.Wait()
+		stopComponents()
+	}()
+
+	health := &server.Health{
+		DataDirectory:         *dataDirectory,
+		GitExecutableFilepath: *git,
+		Version:               version,
+	}
+
+	if gitBackend.Name() == server.BackendGoGit {
+		health.GitExecutableFilepath = ""
+	}
+
+	var accessLogger *server.AccessLog
+	if *accessLog != "" {
+		ctx := log.WithLogger(componentsCtx, log.From(ctx).
+			WithField("component", "access-log"),
+		)
+
+		accessLogger = &server.AccessLog{
+			Filepath: *accessLog,
+		}
+
+		if err := accessLogger.Open(); err != nil {
+			return fmt.Errorf("access log open: %w", err)
+		}
+
+		g.Go(func() error {
+			return accessLogger.Run(ctx)
+		})
+	}
+
+	var authorizer *server.Authorizer
+	if *authzPolicy != "" {
+		ctx := log.WithLogger(componentsCtx, log.From(ctx).
+			WithField("component", "authz"),
+		)
+
+		authorizer = &server.Authorizer{
+			PolicyFilepath: *authzPolicy,
+		}
+
+		if err := authorizer.Load(ctx); err != nil {
+			return fmt.Errorf("authorizer load: %w", err)
+		}
+
+		g.Go(func() error {
+			return authorizer.Run(ctx)
+		})
+	}
+
+	var notifier *server.Notifier
+	if *webhooks != "" {
+		ctx := log.WithLogger(componentsCtx, log.From(ctx).
+			WithField("component", "webhooks"),
+		)
+
+		notifier = &server.Notifier{
+			ConfigFilepath:        *webhooks,
+			GitExecutableFilepath: *git,
+			StateDirectory:        *stateDirectory,
+		}
+
+		if err := notifier.Load(ctx); err != nil {
+			return fmt.Errorf("notifier load: %w", err)
+		}
+
+		g.Go(func() error {
+			return notifier.Run(ctx)
+		})
+	}
+
+	var mirrorer *server.Mirrors
+	if *mirrors != "" {
+		ctx := log.WithLogger(componentsCtx, log.From(ctx).
+			WithField("component", "mirrors"),
+		)
+
+		mirrorer = &server.Mirrors{
+			ConfigFilepath:        *mirrors,
+			DataDirectory:         *dataDirectory,
+			GitExecutableFilepath: *git,
+		}
+
+		if err := mirrorer.Load(ctx); err != nil {
+			return fmt.Errorf("mirrors load: %w", err)
+		}
+
+		g.Go(func() error {
+			return mirrorer.Run(ctx)
+		})
+	}
+
+	var pushMirrorer *server.PushMirrors
+	if *pushMirrors != "" {
+		ctx := log.WithLogger(componentsCtx, log.From(ctx).
+			WithField("component", "push-mirrors"),
+		)
+
+		pushMirrorer = &server.PushMirrors{
+			ConfigFilepath:        *pushMirrors,
+			DataDirectory:         *dataDirectory,
+			GitExecutableFilepath: *git,
+		}
+
+		if err := pushMirrorer.Load(ctx); err != nil {
+			return fmt.Errorf("push mirrors load: %w", err)
+		}
+
+		g.Go(func() error {
+			return pushMirrorer.Run(ctx)
+		})
+	}
+
 	g.Go(func() error {
+		defer servers.Done()
+
 		ctx := log.WithLogger(ctx, log.From(ctx).
 			WithField("component", "http"),
 		)
 
 		return (&server.HTTPServer{
+			AccessLog:             accessLogger,
+			Authorizer:            authorizer,
+			AutoCreate:            autoCreatePolicy,
+			Backend:               gitBackend,
 			BindAddress:           *httpBindAddr,
+			CredentialsFilepath:   *httpCredentials,
 			DataDirectory:         *dataDirectory,
 			GitExecutableFilepath: *git,
+			Health:                health,
+			Hooks:                 hooks,
+			Mirrors:               mirrorer,
 			NoAuth:                *httpNoAuth,
+			Notifier:              notifier,
 			Password:              *httpPassword,
+			PushMirrors:           pushMirrorer,
+			ShutdownTimeout:       *shutdownTimeout,
+			TLSCertFilepath:       *httpTLSCert,
+			TLSClientCAFilepath:   *httpTLSClientCA,
+			TLSKeyFilepath:        *httpTLSKey,
+			TLSRequireClientCert:  *httpTLSRequireClientCert,
+			TLSSelfSigned:         *httpTLSSelfSigned,
+			TokensFilepath:        *httpTokens,
 			Username:              *httpUsername,
 		}).Run(ctx)
 	})
 
 	g.Go(func() error {
+		defer servers.Done()
+
 		ctx := log.WithLogger(ctx, log.From(ctx).
 			WithField("component", "ssh"),
 		)
 
 		return (&server.SSHServer{
+			AccessLog:              accessLogger,
 			AuthorizedKeysFilepath: *sshAuthorizedKeys,
+			Authorizer:             authorizer,
+			AutoCreate:             autoCreatePolicy,
+			Backend:                gitBackend,
 			BindAddress:            *sshBindAddr,
 			DataDirectory:          *dataDirectory,
-			GitExecutableFilepath:  *git,
+			Health:                 health,
 			HostKeyFilepath:        *sshHostKey,
+			Hooks:                  hooks,
+			Mirrors:                mirrorer,
 			NoAuth:                 *sshNoAuth,
+			Notifier:               notifier,
+			PushMirrors:            pushMirrorer,
+			ShutdownTimeout:        *shutdownTimeout,
 		}).Run(ctx)
 	})
 
+	if *metricsBindAddr != "" {
+		g.Go(func() error {
+			ctx := log.WithLogger(ctx, log.From(ctx).
+				WithField("component", "metrics"),
+			)
+
+			return (&server.MetricsServer{
+				BindAddress:   *metricsBindAddr,
+				DataDirectory: *dataDirectory,
+			}).Run(ctx)
+		})
+	}
+
 	if err := g.Wait(); err != nil {
 		log.From(ctx).Error(err)
 	}
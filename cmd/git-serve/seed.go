@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/peterbourgon/ff/v3"
+	"github.com/peterbourgon/ff/v3/ffcli"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+	"github.com/cirocosta/git-serve/pkg/server"
+)
+
+var (
+	seedFlagSet = flag.NewFlagSet("git-serve seed", flag.ExitOnError)
+
+	seedDataDirectory = seedFlagSet.String(
+		"data-dir", server.HTTPDefaultDataDirectory,
+		"directory where repositories are stored",
+	)
+
+	seedGit = seedFlagSet.String(
+		"git", server.HTTPDefaultGitExecutableFilepath,
+		"absolute path to git executable",
+	)
+
+	seedRepositories = seedFlagSet.String(
+		"repositories", "",
+		"path to yaml/json file declaring the repositories to create and "+
+			"what to seed them with (required)",
+	)
+
+	seedHooksDir = seedFlagSet.String(
+		"hooks-dir", "",
+		"path to directory with hooks to install into created repositories",
+	)
+
+	seedStatusFile = seedFlagSet.String(
+		"status-file", "",
+		"path to file to write the status of each repository to as json "+
+			"(e.g., /dev/termination-log) (default: stdout)",
+	)
+)
+
+func seedCommand() *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "seed",
+		ShortUsage: "git-serve seed -repositories <file> [flags]",
+		ShortHelp:  "create repositories that don't exist yet, seeding them",
+		FlagSet:    seedFlagSet,
+		Options:    []ff.Option{ff.WithEnvVarPrefix("GIT_SERVE")},
+		Exec:       seed,
+	}
+}
+
+func seed(ctx context.Context, args []string) error {
+	if *seedRepositories == "" {
+		return fmt.Errorf("-repositories must be provided")
+	}
+
+	var hooks *server.Hooks
+	if *seedHooksDir != "" {
+		hooks = &server.Hooks{Directory: *seedHooksDir}
+	}
+
+	config, err := server.LoadRepositoriesConfig(*seedRepositories)
+	if err != nil {
+		return fmt.Errorf("load repositories: %w", err)
+	}
+
+	ctx = log.WithLogger(ctx, log.From(ctx).WithField("component", "seed"))
+	statuses, seedErr := server.SeedRepositories(ctx, *seedGit, *seedDataDirectory, config, hooks)
+
+	out := os.Stdout
+	if *seedStatusFile != "" {
+		out, err = os.Create(*seedStatusFile)
+		if err != nil {
+			return fmt.Errorf("create '%s': %w", *seedStatusFile, err)
+		}
+		defer out.Close()
+	}
+
+	if err := json.NewEncoder(out).Encode(statuses); err != nil {
+		return fmt.Errorf("encode statuses: %w", err)
+	}
+
+	return seedErr
+}
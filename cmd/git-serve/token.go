@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/peterbourgon/ff/v3"
+	"github.com/peterbourgon/ff/v3/ffcli"
+
+	"github.com/cirocosta/git-serve/pkg/server"
+)
+
+var (
+	tokenFlagSet = flag.NewFlagSet("git-serve token", flag.ExitOnError)
+
+	tokenFile = tokenFlagSet.String(
+		"http-tokens", "tokens.json",
+		"path to the file where access tokens are stored",
+	)
+
+	tokenCreateFlagSet = flag.NewFlagSet("git-serve token create", flag.ExitOnError)
+
+	tokenCreateName = tokenCreateFlagSet.String(
+		"name", "",
+		"name identifying the token (required)",
+	)
+
+	tokenCreateScopes = tokenCreateFlagSet.String(
+		"scopes", string(server.AccessRead),
+		"comma-separated access granted by the token (read,write)",
+	)
+
+	tokenCreateRepositories = tokenCreateFlagSet.String(
+		"repositories", "",
+		"comma-separated globs of repositories the token is restricted to "+
+			"(default: all)",
+	)
+
+	tokenCreateExpiresIn = tokenCreateFlagSet.Duration(
+		"expires-in", 0,
+		"how long until the token expires (default: never)",
+	)
+
+	tokenRevokeFlagSet = flag.NewFlagSet("git-serve token revoke", flag.ExitOnError)
+
+	tokenRevokeName = tokenRevokeFlagSet.String(
+		"name", "",
+		"name of the token to revoke (required)",
+	)
+)
+
+func tokenCommand() *ffcli.Command {
+	return &ffcli.Command{
+		Name:       "token",
+		ShortUsage: "git-serve token [flags] <create|list|revoke> [flags]",
+		ShortHelp:  "manage access tokens for the http transport",
+		FlagSet:    tokenFlagSet,
+		Options:    []ff.Option{ff.WithEnvVarPrefix("GIT_SERVE")},
+		Subcommands: []*ffcli.Command{
+			{
+				Name:       "create",
+				ShortUsage: "git-serve token create -name <name> [flags]",
+				ShortHelp:  "create a token, printing it",
+				FlagSet:    tokenCreateFlagSet,
+				Exec:       tokenCreate,
+			},
+			{
+				Name:       "list",
+				ShortUsage: "git-serve token list",
+				ShortHelp:  "list tokens",
+				Exec:       tokenList,
+			},
+			{
+				Name:       "revoke",
+				ShortUsage: "git-serve token revoke -name <name>",
+				ShortHelp:  "revoke a token",
+				FlagSet:    tokenRevokeFlagSet,
+				Exec:       tokenRevoke,
+			},
+		},
+		Exec: func(ctx context.Context, args []string) error {
+			return flag.ErrHelp
+		},
+	}
+}
+
+func tokenCreate(ctx context.Context, args []string) error {
+	tokens, err := server.LoadTokens(*tokenFile)
+	if err != nil {
+		return fmt.Errorf("load tokens: %w", err)
+	}
+
+	var scopes []server.Access
+	for _, scope := range splitList(*tokenCreateScopes) {
+		switch access := server.Access(scope); access {
+		case server.AccessRead, server.AccessWrite:
+			scopes = append(scopes, access)
+		default:
+			return fmt.Errorf("unknown scope '%s' (expected read or write)", scope)
+		}
+	}
+
+	var expiresAt *time.Time
+	if *tokenCreateExpiresIn != 0 {
+		t := time.Now().UTC().Add(*tokenCreateExpiresIn)
+		expiresAt = &t
+	}
+
+	secret, err := tokens.Create(
+		*tokenCreateName, scopes,
+		splitList(*tokenCreateRepositories), expiresAt,
+	)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+
+	if err := tokens.Save(*tokenFile); err != nil {
+		return fmt.Errorf("save tokens: %w", err)
+	}
+
+	fmt.Println(secret)
+	return nil
+}
+
+func tokenList(ctx context.Context, args []string) error {
+	tokens, err := server.LoadTokens(*tokenFile)
+	if err != nil {
+		return fmt.Errorf("load tokens: %w", err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSCOPES\tREPOSITORIES\tCREATED\tEXPIRES")
+
+	now := time.Now()
+	for _, token := range tokens.Tokens {
+		scopes := make([]string, 0, len(token.Scopes))
+		for _, scope := range token.Scopes {
+			scopes = append(scopes, string(scope))
+		}
+
+		repositories := "*"
+		if len(token.Repositories) > 0 {
+			repositories = strings.Join(token.Repositories, ",")
+		}
+
+		expires := "never"
+		if token.ExpiresAt != nil {
+			expires = token.ExpiresAt.Format(time.RFC3339)
+			if token.IsExpired(now) {
+				expires += " (expired)"
+			}
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			token.Name,
+			strings.Join(scopes, ","),
+			repositories,
+			token.CreatedAt.Format(time.RFC3339),
+			expires,
+		)
+	}
+
+	return w.Flush()
+}
+
+func tokenRevoke(ctx context.Context, args []string) error {
+	tokens, err := server.LoadTokens(*tokenFile)
+	if err != nil {
+		return fmt.Errorf("load tokens: %w", err)
+	}
+
+	if !tokens.Revoke(*tokenRevokeName) {
+		return fmt.Errorf("token '%s' not found", *tokenRevokeName)
+	}
+
+	if err := tokens.Save(*tokenFile); err != nil {
+		return fmt.Errorf("save tokens: %w", err)
+	}
+
+	return nil
+}
+
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
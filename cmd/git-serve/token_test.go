@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitList(t *testing.T) {
+	for _, tc := range []struct {
+		v     string
+		items []string
+	}{
+		{"", nil},
+		{" , ,", nil},
+		{"read", []string{"read"}},
+		{"read,write", []string{"read", "write"}},
+		{" team/* , foo.git,", []string{"team/*", "foo.git"}},
+	} {
+		if items := splitList(tc.v); !reflect.DeepEqual(items, tc.items) {
+			t.Errorf("splitList(%q): expected %q, got %q", tc.v, tc.items, items)
+		}
+	}
+}
@@ -11,12 +11,15 @@ const (
 	GitServerConditionDeploymentReady apis.ConditionType = "DeploymentReady"
 	GitServerConditionServiceReady    apis.ConditionType = "ServiceReady"
 	GitServerConditionSecretReady     apis.ConditionType = "SecretReady"
+
+	GitServerConditionPersistentVolumeClaimReady apis.ConditionType = "PersistentVolumeClaimReady"
 )
 
 var gitServerCondSet = apis.NewLivingConditionSet(
 	GitServerConditionDeploymentReady,
 	GitServerConditionServiceReady,
 	GitServerConditionSecretReady,
+	GitServerConditionPersistentVolumeClaimReady,
 )
 
 func (s *GitServerStatus) GetObservedGeneration() int64 {
@@ -76,3 +79,31 @@ func (s *GitServerStatus) PropagateSecretStatus() {
 	// secrets don't have meaningful status
 	gitServerCondSet.Manage(s).MarkTrue(GitServerConditionSecretReady)
 }
+
+func (s *GitServerStatus) PropagatePersistentVolumeClaimStatus(cs *corev1.PersistentVolumeClaimStatus) {
+	switch cs.Phase {
+	case corev1.ClaimBound:
+		gitServerCondSet.Manage(s).MarkTrue(GitServerConditionPersistentVolumeClaimReady)
+	case corev1.ClaimLost:
+		gitServerCondSet.Manage(s).MarkFalse(GitServerConditionPersistentVolumeClaimReady,
+			"Lost", "the volume bound to the claim no longer exists",
+		)
+	default:
+		// claims of storage classes that bind only once a pod makes use
+		// of them stay pending until the deployment's pod gets scheduled.
+		gitServerCondSet.Manage(s).MarkUnknown(GitServerConditionPersistentVolumeClaimReady,
+			"Pending", "waiting for the claim to be bound",
+		)
+	}
+}
+
+func (s *GitServerStatus) MarkPersistentVolumeClaimNotFound(name string) {
+	gitServerCondSet.Manage(s).MarkFalse(GitServerConditionPersistentVolumeClaimReady,
+		"NotFound", "persistentvolumeclaim %q not found", name,
+	)
+}
+
+func (s *GitServerStatus) MarkPersistentVolumeClaimNotRequired() {
+	// repositories are kept in an emptyDir - nothing to wait for
+	gitServerCondSet.Manage(s).MarkTrue(GitServerConditionPersistentVolumeClaimReady)
+}
@@ -5,6 +5,8 @@ import (
 	"net/url"
 
 	"github.com/vmware-labs/reconciler-runtime/apis"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -21,6 +23,86 @@ type GitServerSpec struct {
 	SSH *GitServerSpecSSH `json:"ssh,omitempty"`
 	// +optional
 	HTTP *GitServerSpecHTTP `json:"http,omitempty"`
+
+	// Storage is where repositories are kept: without it, they're lost
+	// whenever the pod gets recreated.
+	// +optional
+	Storage *GitServerSpecStorage `json:"storage,omitempty"`
+
+	// Repositories are created before the server starts serving (if they
+	// don't exist yet), optionally seeded with content.
+	// +optional
+	Repositories []GitServerSpecRepository `json:"repositories,omitempty"`
+}
+
+type GitServerSpecRepository struct {
+	// Name is the name of the repository (e.g., `team/foo.git`).
+	Name string `json:"name"`
+
+	// DefaultBranch is the branch that HEAD points at (defaults to git's
+	// own default, or the source's HEAD when seeded from a bundle or
+	// repository).
+	// +optional
+	DefaultBranch string `json:"defaultBranch,omitempty"`
+
+	// Source is what the repository gets seeded with when created.
+	// +optional
+	Source *GitServerSpecRepositorySource `json:"source,omitempty"`
+}
+
+// GitServerSpecRepositorySource is where the initial contents of a
+// repository come from - exactly one of the fields must be set.
+type GitServerSpecRepositorySource struct {
+	// Tarball is a (possibly gzipped) tarball of files to be committed to
+	// the default branch.
+	// +optional
+	Tarball *GitServerSpecRepositorySourceFile `json:"tarball,omitempty"`
+
+	// Bundle is a bundle (`git bundle create`) to fetch the branches and
+	// tags from.
+	// +optional
+	Bundle *GitServerSpecRepositorySourceFile `json:"bundle,omitempty"`
+
+	// Path is a directory inside the image: a repository to fetch the
+	// branches and tags from, or otherwise plain files to be committed
+	// to the default branch.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// GitServerSpecRepositorySourceFile is a file kept under a key of either a
+// ConfigMap (`binaryData` for binary files) or a Secret.
+type GitServerSpecRepositorySourceFile struct {
+	// +optional
+	ConfigMapKeyRef *ConfigMapKeyRef `json:"configMapKeyRef,omitempty"`
+	// +optional
+	SecretKeyRef *SecretKeyRef `json:"secretKeyRef,omitempty"`
+}
+
+type GitServerSpecStorage struct {
+	// Size is the capacity requested for the claim created for the
+	// repositories (defaults to 1Gi). Can only be increased, and only
+	// if the storage class allows volume expansion.
+	// +optional
+	Size *resource.Quantity `json:"size,omitempty"`
+
+	// StorageClassName is the name of the storage class of the claim
+	// created for the repositories (defaults to the cluster's default
+	// storage class).
+	// +optional
+	StorageClassName *string `json:"storageClassName,omitempty"`
+
+	// AccessModes of the claim created for the repositories (defaults to
+	// ReadWriteOnce).
+	// +optional
+	AccessModes []corev1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+
+	// ClaimName is the name of an existing PersistentVolumeClaim in the
+	// same namespace to keep the repositories in, rather than having one
+	// created (and owned) for the GitServer - taking precedence over
+	// size, storageClassName and accessModes.
+	// +optional
+	ClaimName string `json:"claimName,omitempty"`
 }
 
 type GitServerSpecHTTP struct {
@@ -65,15 +147,40 @@ type SecretKeyRef struct {
 	Key  string `json:"key"`
 }
 
+type ConfigMapKeyRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
 // GitServerStatus defines the observed state of GitServer
 //
 type GitServerStatus struct {
 	apis.Status `json:",inline"`
 
-	DeploymentRef *TypedLocalObjectReference `json:"deploymentRef,omitempty"`
-	ServiceRef    *TypedLocalObjectReference `json:"serviceRef,omitempty"`
-	SecretRef     *TypedLocalObjectReference `json:"secretRef,omitempty"`
-	Address       *Addressable               `json:"address,omitempty"`
+	DeploymentRef            *TypedLocalObjectReference `json:"deploymentRef,omitempty"`
+	ServiceRef               *TypedLocalObjectReference `json:"serviceRef,omitempty"`
+	SecretRef                *TypedLocalObjectReference `json:"secretRef,omitempty"`
+	PersistentVolumeClaimRef *TypedLocalObjectReference `json:"persistentVolumeClaimRef,omitempty"`
+	Address                  *Addressable               `json:"address,omitempty"`
+
+	// Repositories is the status of each repository declared in the
+	// spec, as of when the current pod started.
+	Repositories []GitServerRepositoryStatus `json:"repositories,omitempty"`
+}
+
+type GitServerRepositoryStatus struct {
+	Name string `json:"name"`
+
+	// Created tells whether the repository exists.
+	Created bool `json:"created"`
+
+	// Head is the commit that HEAD pointed at when the pod started.
+	// +optional
+	Head string `json:"head,omitempty"`
+
+	// Error is why the repository couldn't be created, if it couldn't.
+	// +optional
+	Error string `json:"error,omitempty"`
 }
 
 // +k8s:deepcopy-gen=true
@@ -6,6 +6,7 @@
 package v1alpha1
 
 import (
+	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -24,6 +25,21 @@ func (in *Addressable) DeepCopy() *Addressable {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigMapKeyRef) DeepCopyInto(out *ConfigMapKeyRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigMapKeyRef.
+func (in *ConfigMapKeyRef) DeepCopy() *ConfigMapKeyRef {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigMapKeyRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GitServer) DeepCopyInto(out *GitServer) {
 	*out = *in
@@ -83,6 +99,21 @@ func (in *GitServerList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitServerRepositoryStatus) DeepCopyInto(out *GitServerRepositoryStatus) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitServerRepositoryStatus.
+func (in *GitServerRepositoryStatus) DeepCopy() *GitServerRepositoryStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(GitServerRepositoryStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GitServerSpec) DeepCopyInto(out *GitServerSpec) {
 	*out = *in
@@ -96,6 +127,18 @@ func (in *GitServerSpec) DeepCopyInto(out *GitServerSpec) {
 		*out = new(GitServerSpecHTTP)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.Storage != nil {
+		in, out := &in.Storage, &out.Storage
+		*out = new(GitServerSpecStorage)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Repositories != nil {
+		in, out := &in.Repositories, &out.Repositories
+		*out = make([]GitServerSpecRepository, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitServerSpec.
@@ -181,6 +224,76 @@ func (in *GitServerSpecHTTPAuthUsername) DeepCopy() *GitServerSpecHTTPAuthUserna
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitServerSpecRepository) DeepCopyInto(out *GitServerSpecRepository) {
+	*out = *in
+	if in.Source != nil {
+		in, out := &in.Source, &out.Source
+		*out = new(GitServerSpecRepositorySource)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitServerSpecRepository.
+func (in *GitServerSpecRepository) DeepCopy() *GitServerSpecRepository {
+	if in == nil {
+		return nil
+	}
+	out := new(GitServerSpecRepository)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitServerSpecRepositorySource) DeepCopyInto(out *GitServerSpecRepositorySource) {
+	*out = *in
+	if in.Tarball != nil {
+		in, out := &in.Tarball, &out.Tarball
+		*out = new(GitServerSpecRepositorySourceFile)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Bundle != nil {
+		in, out := &in.Bundle, &out.Bundle
+		*out = new(GitServerSpecRepositorySourceFile)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitServerSpecRepositorySource.
+func (in *GitServerSpecRepositorySource) DeepCopy() *GitServerSpecRepositorySource {
+	if in == nil {
+		return nil
+	}
+	out := new(GitServerSpecRepositorySource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitServerSpecRepositorySourceFile) DeepCopyInto(out *GitServerSpecRepositorySourceFile) {
+	*out = *in
+	if in.ConfigMapKeyRef != nil {
+		in, out := &in.ConfigMapKeyRef, &out.ConfigMapKeyRef
+		*out = new(ConfigMapKeyRef)
+		**out = **in
+	}
+	if in.SecretKeyRef != nil {
+		in, out := &in.SecretKeyRef, &out.SecretKeyRef
+		*out = new(SecretKeyRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitServerSpecRepositorySourceFile.
+func (in *GitServerSpecRepositorySourceFile) DeepCopy() *GitServerSpecRepositorySourceFile {
+	if in == nil {
+		return nil
+	}
+	out := new(GitServerSpecRepositorySourceFile)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GitServerSpecSSH) DeepCopyInto(out *GitServerSpecSSH) {
 	*out = *in
@@ -254,6 +367,36 @@ func (in *GitServerSpecSSHAuthHostKey) DeepCopy() *GitServerSpecSSHAuthHostKey {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitServerSpecStorage) DeepCopyInto(out *GitServerSpecStorage) {
+	*out = *in
+	if in.Size != nil {
+		in, out := &in.Size, &out.Size
+		x := (*in).DeepCopy()
+		*out = &x
+	}
+	if in.StorageClassName != nil {
+		in, out := &in.StorageClassName, &out.StorageClassName
+		*out = new(string)
+		**out = **in
+	}
+	if in.AccessModes != nil {
+		in, out := &in.AccessModes, &out.AccessModes
+		*out = make([]v1.PersistentVolumeAccessMode, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitServerSpecStorage.
+func (in *GitServerSpecStorage) DeepCopy() *GitServerSpecStorage {
+	if in == nil {
+		return nil
+	}
+	out := new(GitServerSpecStorage)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GitServerStatus) DeepCopyInto(out *GitServerStatus) {
 	*out = *in
@@ -273,11 +416,21 @@ func (in *GitServerStatus) DeepCopyInto(out *GitServerStatus) {
 		*out = new(TypedLocalObjectReference)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.PersistentVolumeClaimRef != nil {
+		in, out := &in.PersistentVolumeClaimRef, &out.PersistentVolumeClaimRef
+		*out = new(TypedLocalObjectReference)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Address != nil {
 		in, out := &in.Address, &out.Address
 		*out = new(Addressable)
 		**out = **in
 	}
+	if in.Repositories != nil {
+		in, out := &in.Repositories, &out.Repositories
+		*out = make([]GitServerRepositoryStatus, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitServerStatus.
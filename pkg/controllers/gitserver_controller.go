@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
 	"github.com/vmware-labs/reconciler-runtime/reconcilers"
@@ -9,6 +10,7 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -25,6 +27,16 @@ const (
 	GitServerSSHDataKeyKnownHosts     = "known_hosts"
 )
 
+// GitServerDefaultStorageSize is the capacity requested for the claims
+// created for repositories when the GitServer doesn't specify one.
+//
+const GitServerDefaultStorageSize = "1Gi"
+
+// GitServerGroupID is the id of the group that git-serve runs as in the
+// image (see Dockerfile).
+//
+const GitServerGroupID = 1000
+
 func GitServerReconciler(c reconcilers.Config, defaultImage string) *reconcilers.ParentReconciler {
 	return &reconcilers.ParentReconciler{
 		Type: &v1alpha1.GitServer{},
@@ -33,8 +45,11 @@ func GitServerReconciler(c reconcilers.Config, defaultImage string) *reconcilers
 			GitServerChildSecretSyncReconciler(c),
 			GitServerChildSecretSyncParentSpecReconciler(c),
 			GitServerChildSecretReconciler(c),
+			GitServerChildPersistentVolumeClaimReconciler(c),
+			GitServerExistingPersistentVolumeClaimReconciler(c),
 			GitServerChildServiceReconciler(c),
 			GitServerChildDeploymentReconciler(c),
+			GitServerRepositoriesStatusReconciler(c),
 		},
 
 		Config: c,
@@ -241,9 +256,197 @@ func GitServerDesiredSecretChild(
 		secret.Data[GitServerSSHDataKeyAuthorizedKeys] = secret.Data[GitServerSSHDataKeyPublicKey]
 	}
 
+	delete(secret.Data, GitServerSeedDataKeyRepositories)
+	if len(parent.Spec.Repositories) > 0 {
+		repositories, err := json.Marshal(GitServerRepositoriesConfig(parent))
+		if err != nil {
+			return nil, fmt.Errorf("marshal repositories: %w", err)
+		}
+
+		secret.Data[GitServerSeedDataKeyRepositories] = repositories
+	}
+
 	return secret, nil
 }
 
+func GitServerChildPersistentVolumeClaimReconciler(c reconcilers.Config) reconcilers.SubReconciler {
+	c.Log = c.Log.WithName("child-persistentvolumeclaim")
+
+	return &reconcilers.ChildReconciler{
+		Config: c,
+
+		ChildType:     &corev1.PersistentVolumeClaim{},
+		ChildListType: &corev1.PersistentVolumeClaimList{},
+
+		DesiredChild: GitServerDesiredPersistentVolumeClaimChild,
+
+		ReflectChildStatusOnParent: func(parent *v1alpha1.GitServer, child *corev1.PersistentVolumeClaim, err error) {
+			if child == nil {
+				parent.Status.PersistentVolumeClaimRef = nil
+
+				// an existing claim is reflected by the
+				// reconciler that looks it up.
+				if parent.Spec.Storage == nil {
+					parent.Status.MarkPersistentVolumeClaimNotRequired()
+				}
+
+				return
+			}
+
+			parent.Status.PersistentVolumeClaimRef = v1alpha1.
+				NewTypedLocalObjectReferenceForObject(
+					child, c.Scheme(),
+				)
+
+			parent.Status.PropagatePersistentVolumeClaimStatus(&child.Status)
+		},
+
+		HarmonizeImmutableFields: func(current, desired *corev1.PersistentVolumeClaim) {
+		},
+
+		// apart from the size, which can be increased, the spec of a
+		// claim can't be changed once created.
+		//
+		MergeBeforeUpdate: func(current, desired *corev1.PersistentVolumeClaim) {
+			current.Labels = desired.Labels
+			current.Spec.Resources = desired.Spec.Resources
+		},
+
+		SemanticEquals: func(a1, a2 *corev1.PersistentVolumeClaim) bool {
+			return equality.Semantic.DeepEqual(a1.Spec.Resources, a2.Spec.Resources) &&
+				equality.Semantic.DeepEqual(a1.Labels, a2.Labels)
+		},
+
+		Sanitize: func(child *corev1.PersistentVolumeClaim) interface{} {
+			return child.Spec
+		},
+	}
+}
+
+// GitServerDesiredPersistentVolumeClaimChild is the claim that the
+// repositories get stored in, unless the GitServer doesn't ask for
+// storage, or asks for an existing claim to be used.
+//
+func GitServerDesiredPersistentVolumeClaimChild(
+	ctx context.Context, parent *v1alpha1.GitServer,
+) (*corev1.PersistentVolumeClaim, error) {
+	storage := parent.Spec.Storage
+	if storage == nil || storage.ClaimName != "" {
+		return nil, nil
+	}
+
+	size := resource.MustParse(GitServerDefaultStorageSize)
+	if storage.Size != nil {
+		size = *storage.Size
+	}
+
+	return &corev1.PersistentVolumeClaim{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: corev1.SchemeGroupVersion.Identifier(),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: make(map[string]string),
+			Name:        parent.Name,
+			Namespace:   parent.Namespace,
+			Labels:      GitServerLabel(parent.Name),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      GitServerStorageAccessModes(storage),
+			StorageClassName: storage.StorageClassName,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}, nil
+}
+
+// GitServerExistingPersistentVolumeClaimReconciler looks up the existing
+// claim that a GitServer asks for its repositories to be stored in,
+// reflecting its status, and stashing it for the deployment to be
+// tailored to its access modes.
+//
+func GitServerExistingPersistentVolumeClaimReconciler(c reconcilers.Config) reconcilers.SubReconciler {
+	return &reconcilers.SyncReconciler{
+		Sync: func(ctx context.Context, parent *v1alpha1.GitServer) error {
+			if parent.Spec.Storage == nil || parent.Spec.Storage.ClaimName == "" {
+				return nil
+			}
+
+			name := parent.Spec.Storage.ClaimName
+
+			claim := &corev1.PersistentVolumeClaim{}
+			if err := c.Get(ctx, types.NamespacedName{
+				Name:      name,
+				Namespace: parent.Namespace,
+			}, claim); err != nil {
+				if !kerrors.IsNotFound(err) {
+					return fmt.Errorf("get persistentvolumeclaim '%s': %w",
+						name, err,
+					)
+				}
+
+				parent.Status.PersistentVolumeClaimRef = nil
+				parent.Status.MarkPersistentVolumeClaimNotFound(name)
+				return nil
+			}
+
+			parent.Status.PersistentVolumeClaimRef = v1alpha1.
+				NewTypedLocalObjectReferenceForObject(
+					claim, c.Scheme(),
+				)
+			parent.Status.PropagatePersistentVolumeClaimStatus(&claim.Status)
+
+			StashPersistentVolumeClaim(ctx, claim)
+			return nil
+		},
+	}
+}
+
+// GitServerStorageAccessModes are the access modes of the claim created
+// for the repositories.
+//
+func GitServerStorageAccessModes(storage *v1alpha1.GitServerSpecStorage) []corev1.PersistentVolumeAccessMode {
+	if len(storage.AccessModes) == 0 {
+		return []corev1.PersistentVolumeAccessMode{
+			corev1.ReadWriteOnce,
+		}
+	}
+
+	return storage.AccessModes
+}
+
+// GitServerDeploymentStrategy is the strategy for rolling out new pods:
+// with a volume that can only be mounted by a single node, the old pod
+// must be gone before a new one can start, otherwise the rollout could
+// get stuck with the new pod never getting to mount it.
+//
+func GitServerDeploymentStrategy(ctx context.Context, parent *v1alpha1.GitServer) appsv1.DeploymentStrategy {
+	storage := parent.Spec.Storage
+	if storage == nil {
+		return appsv1.DeploymentStrategy{}
+	}
+
+	var accessModes []corev1.PersistentVolumeAccessMode
+	if storage.ClaimName == "" {
+		accessModes = GitServerStorageAccessModes(storage)
+	} else if claim := RetrievePersistentVolumeClaim(ctx); claim != nil {
+		accessModes = claim.Spec.AccessModes
+	}
+
+	for _, mode := range accessModes {
+		if mode == corev1.ReadWriteMany || mode == corev1.ReadOnlyMany {
+			return appsv1.DeploymentStrategy{}
+		}
+	}
+
+	return appsv1.DeploymentStrategy{
+		Type: appsv1.RecreateDeploymentStrategyType,
+	}
+}
+
 func GitServerChildDeploymentReconciler(c reconcilers.Config) reconcilers.SubReconciler {
 	c.Log = c.Log.WithName("childdeployment")
 
@@ -292,6 +495,11 @@ func GitServerChildDeploymentReconciler(c reconcilers.Config) reconcilers.SubRec
 func GitServerDesiredDeploymentChild(
 	ctx context.Context, parent *v1alpha1.GitServer,
 ) (*appsv1.Deployment, error) {
+	template, err := GitServerPodTemplateSpec(parent)
+	if err != nil {
+		return nil, fmt.Errorf("pod template spec: %w", err)
+	}
+
 	return &appsv1.Deployment{
 		TypeMeta: metav1.TypeMeta{
 			Kind:       "Deployment",
@@ -309,7 +517,8 @@ func GitServerDesiredDeploymentChild(
 				MatchLabels: GitServerLabel(parent.Name),
 			},
 			RevisionHistoryLimit: pointer.Int32Ptr(0),
-			Template:             GitServerPodTemplateSpec(parent),
+			Strategy:             GitServerDeploymentStrategy(ctx, parent),
+			Template:             template,
 		},
 	}, nil
 }
@@ -411,7 +620,7 @@ func GitServerLabel(name string) map[string]string {
 	}
 }
 
-func GitServerPodTemplateSpec(parent *v1alpha1.GitServer) corev1.PodTemplateSpec {
+func GitServerPodTemplateSpec(parent *v1alpha1.GitServer) (corev1.PodTemplateSpec, error) {
 	sshSecretVolume := corev1.Volume{
 		Name: "ssh",
 		VolumeSource: corev1.VolumeSource{
@@ -436,10 +645,43 @@ func GitServerPodTemplateSpec(parent *v1alpha1.GitServer) corev1.PodTemplateSpec
 		},
 	}
 
+	if storage := parent.Spec.Storage; storage != nil {
+		claimName := storage.ClaimName
+		if claimName == "" {
+			claimName = parent.Name
+		}
+
+		gitDataVolume.VolumeSource = corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: claimName,
+			},
+		}
+	}
+
 	container := corev1.Container{
 		Name:            "git-serve",
 		Image:           parent.Spec.Image,
 		ImagePullPolicy: corev1.PullAlways,
+		LivenessProbe: &corev1.Probe{
+			Handler: corev1.Handler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path: "/healthz",
+					Port: intstr.FromInt(int(8080)),
+				},
+			},
+			PeriodSeconds:    10,
+			FailureThreshold: 3,
+		},
+		ReadinessProbe: &corev1.Probe{
+			Handler: corev1.Handler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path: "/readyz",
+					Port: intstr.FromInt(int(8080)),
+				},
+			},
+			PeriodSeconds:    5,
+			FailureThreshold: 2,
+		},
 		VolumeMounts: []corev1.VolumeMount{
 			{
 				Name:      sshSecretVolume.Name,
@@ -506,21 +748,66 @@ func GitServerPodTemplateSpec(parent *v1alpha1.GitServer) corev1.PodTemplateSpec
 		}...)
 	}
 
+	// volumes are usually owned by root, but git-serve runs as the
+	// `nonroot` user (and group) of the image - have them writable by its
+	// group.
+	//
+	var (
+		annotations    map[string]string
+		initContainers []corev1.Container
+		volumes        = []corev1.Volume{sshSecretVolume, gitDataVolume}
+	)
+
+	if len(parent.Spec.Repositories) > 0 {
+		checksum, err := GitServerRepositoriesChecksum(parent)
+		if err != nil {
+			return corev1.PodTemplateSpec{}, fmt.Errorf("repositories checksum: %w", err)
+		}
+
+		annotations = map[string]string{
+			GitServerRepositoriesChecksumAnnotation: checksum,
+		}
+
+		seedVolume := GitServerSeedVolume(parent)
+		volumes = append(volumes, seedVolume)
+		initContainers = append(initContainers,
+			GitServerSeedContainer(parent, seedVolume, gitDataVolume),
+		)
+	}
+
+	var securityContext *corev1.PodSecurityContext
+	if parent.Spec.Storage != nil {
+		securityContext = &corev1.PodSecurityContext{
+			FSGroup: pointer.Int64Ptr(GitServerGroupID),
+		}
+	}
+
 	return corev1.PodTemplateSpec{
 		ObjectMeta: metav1.ObjectMeta{
-			Labels: GitServerLabel(parent.Name),
+			Labels:      GitServerLabel(parent.Name),
+			Annotations: annotations,
 		},
 		Spec: corev1.PodSpec{
+			SecurityContext:               securityContext,
 			TerminationGracePeriodSeconds: pointer.Int64Ptr(60),
-			Volumes: []corev1.Volume{
-				sshSecretVolume,
-				gitDataVolume,
-			},
+			Volumes:                       volumes,
+			InitContainers:                initContainers,
 			Containers: []corev1.Container{
 				container,
 			},
 		},
-	}
+	}, nil
+}
+
+const PersistentVolumeClaimStashKey reconcilers.StashKey = v1alpha1.Group + "/persistentvolumeclaim"
+
+func StashPersistentVolumeClaim(ctx context.Context, claim *corev1.PersistentVolumeClaim) {
+	reconcilers.StashValue(ctx, PersistentVolumeClaimStashKey, claim)
+}
+
+func RetrievePersistentVolumeClaim(ctx context.Context) *corev1.PersistentVolumeClaim {
+	claim, _ := reconcilers.RetrieveValue(ctx, PersistentVolumeClaimStashKey).(*corev1.PersistentVolumeClaim)
+	return claim
 }
 
 const SecretDataStashKey reconcilers.StashKey = v1alpha1.Group + "/secret-data"
@@ -0,0 +1,285 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/vmware-labs/reconciler-runtime/reconcilers"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	v1alpha1 "github.com/cirocosta/git-serve/pkg/apis/v1alpha1"
+	"github.com/cirocosta/git-serve/pkg/server"
+)
+
+const (
+	// GitServerSeedDataKeyRepositories is the key in the GitServer's
+	// secret under which the configuration of the repositories to seed
+	// is kept.
+	//
+	GitServerSeedDataKeyRepositories = "repositories.json"
+
+	// GitServerSeedContainerName is the name of the init container that
+	// creates and seeds the repositories declared in the spec, reporting
+	// their status through its termination message.
+	//
+	GitServerSeedContainerName = "seed"
+
+	// GitServerRepositoriesChecksumAnnotation annotates the pod template
+	// with the checksum of the repositories configuration so that pods
+	// get replaced (and thus new repositories seeded) whenever it changes.
+	//
+	GitServerRepositoriesChecksumAnnotation = v1alpha1.Group + "/repositories-checksum"
+
+	gitServerSeedMountPath = "/seed"
+)
+
+// GitServerRepositoriesConfig is the configuration that `git-serve seed`
+// creates the repositories declared in the spec from, with the files of
+// the sources referring to where they get mounted.
+//
+func GitServerRepositoriesConfig(parent *v1alpha1.GitServer) *server.RepositoriesConfig {
+	config := &server.RepositoriesConfig{
+		Repositories: []server.RepositorySpec{},
+	}
+
+	for idx, repo := range parent.Spec.Repositories {
+		spec := server.RepositorySpec{
+			Name:          repo.Name,
+			DefaultBranch: repo.DefaultBranch,
+		}
+
+		if source := repo.Source; source != nil {
+			spec.Source = &server.RepositorySource{Path: source.Path}
+
+			if source.Tarball != nil {
+				spec.Source.Tarball = gitServerSeedMountPath + "/" +
+					gitServerSeedSourcePath(idx, "tar")
+			}
+
+			if source.Bundle != nil {
+				spec.Source.Bundle = gitServerSeedMountPath + "/" +
+					gitServerSeedSourcePath(idx, "bundle")
+			}
+		}
+
+		config.Repositories = append(config.Repositories, spec)
+	}
+
+	return config
+}
+
+func gitServerSeedSourcePath(idx int, ext string) string {
+	return fmt.Sprintf("sources/%d.%s", idx, ext)
+}
+
+// GitServerSeedVolume projects into a single volume the repositories
+// configuration and the files that the repositories are seeded from.
+//
+func GitServerSeedVolume(parent *v1alpha1.GitServer) corev1.Volume {
+	sources := []corev1.VolumeProjection{
+		{
+			Secret: &corev1.SecretProjection{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: parent.Name,
+				},
+				Items: []corev1.KeyToPath{
+					{
+						Key:  GitServerSeedDataKeyRepositories,
+						Path: GitServerSeedDataKeyRepositories,
+					},
+				},
+			},
+		},
+	}
+
+	for idx, repo := range parent.Spec.Repositories {
+		if repo.Source == nil {
+			continue
+		}
+
+		if projection, ok := gitServerSeedFileProjection(
+			repo.Source.Tarball, gitServerSeedSourcePath(idx, "tar"),
+		); ok {
+			sources = append(sources, projection)
+		}
+
+		if projection, ok := gitServerSeedFileProjection(
+			repo.Source.Bundle, gitServerSeedSourcePath(idx, "bundle"),
+		); ok {
+			sources = append(sources, projection)
+		}
+	}
+
+	return corev1.Volume{
+		Name: "seed",
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: sources,
+			},
+		},
+	}
+}
+
+// gitServerSeedFileProjection projects the ConfigMap or Secret key that a
+// source file refers to into `path` - with neither, nothing is projected,
+// leaving it for the seeding of the repository to fail with the file not
+// being found.
+//
+func gitServerSeedFileProjection(file *v1alpha1.GitServerSpecRepositorySourceFile, path string) (corev1.VolumeProjection, bool) {
+	switch {
+	case file == nil:
+		return corev1.VolumeProjection{}, false
+
+	case file.SecretKeyRef != nil:
+		return corev1.VolumeProjection{
+			Secret: &corev1.SecretProjection{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: file.SecretKeyRef.Name,
+				},
+				Items: []corev1.KeyToPath{
+					{Key: file.SecretKeyRef.Key, Path: path},
+				},
+			},
+		}, true
+
+	case file.ConfigMapKeyRef != nil:
+		return corev1.VolumeProjection{
+			ConfigMap: &corev1.ConfigMapProjection{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: file.ConfigMapKeyRef.Name,
+				},
+				Items: []corev1.KeyToPath{
+					{Key: file.ConfigMapKeyRef.Key, Path: path},
+				},
+			},
+		}, true
+	}
+
+	return corev1.VolumeProjection{}, false
+}
+
+// GitServerSeedContainer is the init container that makes sure that the
+// repositories declared in the spec exist before git-serve starts.
+//
+func GitServerSeedContainer(parent *v1alpha1.GitServer, seedVolume, gitDataVolume corev1.Volume) corev1.Container {
+	return corev1.Container{
+		Name:            GitServerSeedContainerName,
+		Image:           parent.Spec.Image,
+		ImagePullPolicy: corev1.PullAlways,
+		Args: []string{
+			"git-serve",
+			"seed",
+			"-data-dir=/git-data",
+			"-repositories=" + gitServerSeedMountPath + "/" + GitServerSeedDataKeyRepositories,
+			"-status-file=/dev/termination-log",
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      seedVolume.Name,
+				MountPath: gitServerSeedMountPath,
+			},
+			{
+				Name:      gitDataVolume.Name,
+				MountPath: "/git-data",
+			},
+		},
+	}
+}
+
+// GitServerRepositoriesChecksum is the checksum of the repositories
+// configuration.
+//
+func GitServerRepositoriesChecksum(parent *v1alpha1.GitServer) (string, error) {
+	content, err := json.Marshal(GitServerRepositoriesConfig(parent))
+	if err != nil {
+		return "", fmt.Errorf("marshal: %w", err)
+	}
+
+	return fmt.Sprintf("%x", sha256.Sum256(content)), nil
+}
+
+// GitServerRepositoriesStatusReconciler reflects the status of the
+// repositories as reported by the seed container of the most recent pod.
+//
+func GitServerRepositoriesStatusReconciler(c reconcilers.Config) reconcilers.SubReconciler {
+	return &reconcilers.SyncReconciler{
+		Sync: func(ctx context.Context, parent *v1alpha1.GitServer) error {
+			if len(parent.Spec.Repositories) == 0 {
+				parent.Status.Repositories = nil
+				return nil
+			}
+
+			// not going through the cache as that'd mean keeping
+			// every pod of the cluster in memory.
+			//
+			pods := &corev1.PodList{}
+			if err := c.APIReader.List(ctx, pods,
+				client.InNamespace(parent.Namespace),
+				client.MatchingLabels(GitServerLabel(parent.Name)),
+			); err != nil {
+				return fmt.Errorf("list pods: %w", err)
+			}
+
+			sort.Slice(pods.Items, func(i, j int) bool {
+				return pods.Items[j].CreationTimestamp.Before(
+					&pods.Items[i].CreationTimestamp,
+				)
+			})
+
+			for _, pod := range pods.Items {
+				statuses, found := gitServerSeedStatuses(&pod)
+				if !found {
+					continue
+				}
+
+				parent.Status.Repositories = statuses
+				return nil
+			}
+
+			return nil
+		},
+	}
+}
+
+// gitServerSeedStatuses parses the status of the repositories out of the
+// termination message of the pod's seed container, if it terminated.
+//
+func gitServerSeedStatuses(pod *corev1.Pod) ([]v1alpha1.GitServerRepositoryStatus, bool) {
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name != GitServerSeedContainerName {
+			continue
+		}
+
+		terminated := status.State.Terminated
+		if terminated == nil {
+			terminated = status.LastTerminationState.Terminated
+		}
+
+		if terminated == nil {
+			return nil, false
+		}
+
+		reported := []server.RepositoryStatus{}
+		if err := json.Unmarshal([]byte(terminated.Message), &reported); err != nil {
+			return nil, false
+		}
+
+		statuses := make([]v1alpha1.GitServerRepositoryStatus, 0, len(reported))
+		for _, repo := range reported {
+			statuses = append(statuses, v1alpha1.GitServerRepositoryStatus{
+				Name:    repo.Name,
+				Created: repo.Created,
+				Head:    repo.Head,
+				Error:   repo.Error,
+			})
+		}
+
+		return statuses, true
+	}
+
+	return nil, false
+}
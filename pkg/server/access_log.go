@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+// AccessLogStdout is the access log filepath that stands for the standard
+// output.
+//
+const AccessLogStdout = "-"
+
+// AccessLog writes a record for every git operation (http request or ssh
+// session) as a line of JSON to a file, or the standard output.
+//
+// As the file is reopened on SIGHUP, it plays well with `logrotate`:
+// rename the file, then signal the process so that it starts writing to a
+// new one.
+//
+// A nil AccessLog records nothing.
+//
+type AccessLog struct {
+	Filepath string
+
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+// accessLogRecord is what gets logged about a git operation.
+//
+type accessLogRecord struct {
+	Time        time.Time `json:"time"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Transport   string    `json:"transport"`
+	Identity    string    `json:"identity,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Repository  string    `json:"repository"`
+	Service     string    `json:"service"`
+	Status      int       `json:"status,omitempty"`
+	ExitCode    *int      `json:"exit_code,omitempty"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	Duration    float64   `json:"duration_seconds"`
+}
+
+// Open opens the file that records get appended to, creating it if needed.
+//
+func (l *AccessLog) Open() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.open()
+}
+
+// Run reopens the file on SIGHUP until the context is cancelled, closing
+// it at the end.
+//
+func (l *AccessLog) Run(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	logger := log.From(ctx).WithField("file", l.Filepath)
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
+	for {
+		select {
+		case <-ctx.Done():
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			if l.file != nil {
+				return l.file.Close()
+			}
+
+			return nil
+		case <-hupCh:
+		}
+
+		l.mu.Lock()
+		err := l.open()
+		l.mu.Unlock()
+
+		if err != nil {
+			logger.WithError(err).Error("reopen")
+			continue
+		}
+
+		logger.Info("sighup received - reopened")
+	}
+}
+
+// open (re)opens the file, only replacing the current one if that
+// succeeds so that records keep going somewhere.
+//
+func (l *AccessLog) open() error {
+	if l.Filepath == "" || l.Filepath == AccessLogStdout {
+		l.w = os.Stdout
+		return nil
+	}
+
+	file, err := os.OpenFile(l.Filepath,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644,
+	)
+	if err != nil {
+		return fmt.Errorf("open '%s': %w", l.Filepath, err)
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+
+	l.w, l.file = file, file
+	return nil
+}
+
+// recordRejection logs a request for `repository` that got rejected with
+// `code` (http status code, or exit code for ssh) before ever becoming a
+// git operation, e.g., for the identity not being allowed to access it.
+//
+func (l *AccessLog) recordRejection(transport string, service gitService, repository string, identity Identity, remoteAddr string, code int) {
+	l.record(&operation{
+		transport:  transport,
+		service:    service.Subcommand(),
+		repository: repository,
+		identity:   identity,
+		remoteAddr: remoteAddr,
+		start:      time.Now(),
+	}, code)
+}
+
+// record logs the operation as finished with `code` (http status code, or
+// exit code of git for ssh).
+//
+func (l *AccessLog) record(op *operation, code int) {
+	if l == nil {
+		return
+	}
+
+	record := accessLogRecord{
+		Time:        op.start.UTC(),
+		RemoteAddr:  op.remoteAddr,
+		Transport:   op.transport,
+		Fingerprint: op.identity.Fingerprint,
+		Repository:  op.repository,
+		Service:     op.service,
+		BytesIn:     atomic.LoadInt64(&op.in),
+		BytesOut:    atomic.LoadInt64(&op.out),
+		Duration:    time.Since(op.start).Seconds(),
+	}
+
+	if !op.identity.IsAnonymous() {
+		record.Identity = op.identity.String()
+	}
+
+	if op.transport == transportSSH {
+		record.ExitCode = &code
+	} else {
+		record.Status = code
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.w == nil {
+		return
+	}
+
+	l.w.Write(append(line, '\n'))
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKeyIdentityVariable is the name of the variable that, when set
+// through an `environment="..."` option of an authorized key, attaches a
+// name to the identity of whoever authenticates with that key.
+//
+const AuthorizedKeyIdentityVariable = "GIT_SERVE_IDENTITY"
+
+// authorizedKey is an entry of an OpenSSH authorized_keys file, along with
+// those of its options that are meaningful for a git server.
+//
+type authorizedKey struct {
+	Key     ssh.PublicKey
+	Comment string
+
+	// Name is the identity attached to the key via
+	// `environment="GIT_SERVE_IDENTITY=<name>"`, if any.
+	//
+	Name string
+
+	// Command, when set (`command="..."`), is run in place of whatever
+	// command the client asks for.
+	//
+	Command string
+
+	// From holds the networks (`from="..."`) that clients authenticating
+	// with this key must come from, with negated entries (`!`) in
+	// NotFrom.
+	//
+	From    []*net.IPNet
+	NotFrom []*net.IPNet
+
+	// NoPTY (`no-pty`) forbids the allocation of a pseudo-terminal.
+	//
+	NoPTY bool
+
+	// ExpiresAt (`expiry-time="..."`) is the moment after which the key
+	// is no longer accepted.
+	//
+	ExpiresAt time.Time
+}
+
+// parseAuthorizedKeys parses the whole of an OpenSSH authorized_keys file:
+// blank lines and comments are skipped, and every key, with its options, is
+// returned. A file without keys is valid, authorizing no one.
+//
+// Lines that can't be parsed, and keys with options that can't be honored
+// (e.g., `from=` hostname patterns), are left out, with the line and the
+// reason why in `invalid`, rather than taking the rest of the file down with
+// them.
+//
+func parseAuthorizedKeys(content []byte) (keys []*authorizedKey, invalid []error) {
+	keys = []*authorizedKey{}
+
+	for idx, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pk, comment, options, _, err := gossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			invalid = append(invalid, fmt.Errorf("line %d: %w", idx+1, err))
+			continue
+		}
+
+		key := &authorizedKey{
+			Key:     pk,
+			Comment: comment,
+		}
+
+		if err := key.applyOptions(options); err != nil {
+			invalid = append(invalid, fmt.Errorf("line %d: key '%s': %w",
+				idx+1, gossh.FingerprintSHA256(pk), err,
+			))
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, invalid
+}
+
+func (k *authorizedKey) applyOptions(options []string) error {
+	for _, option := range options {
+		if err := k.applyOption(option); err != nil {
+			return fmt.Errorf("option '%s': %w", option, err)
+		}
+	}
+
+	return nil
+}
+
+func (k *authorizedKey) applyOption(option string) error {
+	name, value := option, ""
+	if idx := strings.IndexByte(option, '='); idx != -1 {
+		name, value = option[:idx], unquoteOptionValue(option[idx+1:])
+	}
+
+	switch strings.ToLower(name) {
+	case "command":
+		k.Command = value
+	case "no-pty":
+		k.NoPTY = true
+	case "from":
+		for _, pattern := range strings.Split(value, ",") {
+			negated := strings.HasPrefix(pattern, "!")
+
+			network, err := parseNetwork(strings.TrimPrefix(pattern, "!"))
+			if err != nil {
+				return err
+			}
+
+			if negated {
+				k.NotFrom = append(k.NotFrom, network)
+			} else {
+				k.From = append(k.From, network)
+			}
+		}
+	case "expiry-time":
+		t, err := parseExpiryTime(value)
+		if err != nil {
+			return err
+		}
+
+		k.ExpiresAt = t
+	case "environment":
+		idx := strings.IndexByte(value, '=')
+		if idx == -1 {
+			return errors.New("expected NAME=value")
+		}
+
+		if value[:idx] == AuthorizedKeyIdentityVariable {
+			k.Name = value[idx+1:]
+		}
+	}
+
+	return nil
+}
+
+// Allows tells whether the key can be used by a client connecting from
+// `addr` at time `now`.
+//
+func (k *authorizedKey) Allows(addr net.Addr, now time.Time) bool {
+	if !k.ExpiresAt.IsZero() && now.After(k.ExpiresAt) {
+		return false
+	}
+
+	if len(k.From) == 0 && len(k.NotFrom) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range k.NotFrom {
+		if network.Contains(tcpAddr.IP) {
+			return false
+		}
+	}
+
+	if len(k.From) == 0 {
+		return true
+	}
+
+	for _, network := range k.From {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Identity is the name that identifies whoever authenticated with the key:
+// either the one explicitly attached to it or its SHA256 fingerprint.
+//
+func (k *authorizedKey) Identity() string {
+	if k.Name != "" {
+		return k.Name
+	}
+
+	return gossh.FingerprintSHA256(k.Key)
+}
+
+func (k *authorizedKey) String() string {
+	fingerprint := gossh.FingerprintSHA256(k.Key)
+	if k.Name == "" {
+		return fingerprint
+	}
+
+	return k.Name + " (" + fingerprint + ")"
+}
+
+func unquoteOptionValue(v string) string {
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+
+	return strings.ReplaceAll(v, `\"`, `"`)
+}
+
+// parseNetwork parses either a CIDR (`10.0.0.0/8`) or a single address
+// (`10.0.0.1`) into a network.
+//
+func parseNetwork(v string) (*net.IPNet, error) {
+	if strings.Contains(v, "/") {
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("parse cidr '%s': %w", v, err)
+		}
+
+		return network, nil
+	}
+
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, fmt.Errorf("'%s' is neither an address nor a cidr", v)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseExpiryTime parses a timestamp in the format that OpenSSH expects for
+// `expiry-time`: YYYYMMDD[HHMM[SS]], in local time unless suffixed with
+// `Z`.
+//
+func parseExpiryTime(v string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(v, "Z") {
+		v, loc = strings.TrimSuffix(v, "Z"), time.UTC
+	}
+
+	layouts := map[int]string{
+		8:  "20060102",
+		12: "200601021504",
+		14: "20060102150405",
+	}
+
+	layout, ok := layouts[len(v)]
+	if !ok {
+		return time.Time{}, fmt.Errorf("malformed expiry time '%s'", v)
+	}
+
+	t, err := time.ParseInLocation(layout, v, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("parse expiry time '%s': %w", v, err)
+	}
+
+	return t, nil
+}
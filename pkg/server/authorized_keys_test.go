@@ -0,0 +1,150 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testAliceKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMhWvvfhryuN9ydeLfdRXmb6YnhfFF1AsCQTw93gh3ha alice"
+	testBobKey   = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHjuNg/jqb3cNXE+nCsfABBxlvKtNJXjiRXuWQAvoc32 bob"
+)
+
+func TestParseAuthorizedKeys(t *testing.T) {
+	keys, invalid := parseAuthorizedKeys([]byte(`
+# the team
+
+` + testAliceKey + `
+environment="GIT_SERVE_IDENTITY=robert",command="git-upload-pack 'ro.git'",no-pty,expiry-time="20300102Z" ` + testBobKey + `
+`))
+	if len(invalid) != 0 {
+		t.Fatalf("unexpected invalid keys: %v", invalid)
+	}
+
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys, got %d", len(keys))
+	}
+
+	alice, bob := keys[0], keys[1]
+
+	if alice.Comment != "alice" || alice.Name != "" || alice.Command != "" || alice.NoPTY {
+		t.Errorf("unexpected options for alice: %+v", alice)
+	}
+
+	if alice.Identity() != alice.String() {
+		t.Errorf("expected alice to be identified by the fingerprint, got '%s'", alice.Identity())
+	}
+
+	if bob.Name != "robert" || bob.Identity() != "robert" {
+		t.Errorf("expected bob to be named robert, got '%s'", bob.Name)
+	}
+
+	if bob.Command != "git-upload-pack 'ro.git'" {
+		t.Errorf("unexpected command for bob: '%s'", bob.Command)
+	}
+
+	if !bob.NoPTY {
+		t.Errorf("expected no-pty for bob")
+	}
+
+	if expected := time.Date(2030, 1, 2, 0, 0, 0, 0, time.UTC); !bob.ExpiresAt.Equal(expected) {
+		t.Errorf("expected bob to expire at %s, got %s", expected, bob.ExpiresAt)
+	}
+}
+
+func TestParseAuthorizedKeysEmpty(t *testing.T) {
+	for _, content := range []string{"", "\n\n", "# no one\n"} {
+		keys, invalid := parseAuthorizedKeys([]byte(content))
+		if len(invalid) != 0 {
+			t.Fatalf("%q: unexpected invalid keys: %v", content, invalid)
+		}
+
+		if len(keys) != 0 {
+			t.Fatalf("%q: expected no keys, got %d", content, len(keys))
+		}
+	}
+}
+
+func TestParseAuthorizedKeysInvalidOptions(t *testing.T) {
+	for _, options := range []string{
+		`expiry-time="tomorrow"`,
+		`expiry-time="2030010"`,
+		`environment="GIT_SERVE_IDENTITY"`,
+		`from="10.0.0.0/33"`,
+		`from="*.example.com"`,
+		`from="10.0.0.?,10.1.0.0/16"`,
+	} {
+		keys, invalid := parseAuthorizedKeys([]byte(
+			options + " " + testAliceKey + "\n" + testBobKey,
+		))
+
+		if len(invalid) != 1 {
+			t.Errorf("%s: expected alice's key to be invalid, got %v", options, invalid)
+		} else if !strings.HasPrefix(invalid[0].Error(), "line 1: ") {
+			t.Errorf("%s: expected the error to point at line 1, got '%s'", options, invalid[0])
+		}
+
+		if len(keys) != 1 || keys[0].Comment != "bob" {
+			t.Errorf("%s: expected only bob's key to be kept, got %v", options, keys)
+		}
+	}
+}
+
+func TestParseAuthorizedKeysUnparseableLines(t *testing.T) {
+	keys, invalid := parseAuthorizedKeys([]byte(
+		testAliceKey + "\n" +
+			"ssh-ed25519 not-base64 carol\n" +
+			"\n" +
+			"# a comment\n" +
+			"garbage\n" +
+			testBobKey + "\n",
+	))
+
+	if len(keys) != 2 || keys[0].Comment != "alice" || keys[1].Comment != "bob" {
+		t.Fatalf("expected alice's and bob's keys to be kept, got %v", keys)
+	}
+
+	if len(invalid) != 2 {
+		t.Fatalf("expected two unparseable lines, got %v", invalid)
+	}
+
+	for idx, line := range []int{2, 5} {
+		if prefix := fmt.Sprintf("line %d: ", line); !strings.HasPrefix(invalid[idx].Error(), prefix) {
+			t.Errorf("expected '%s' to point at line %d", invalid[idx], line)
+		}
+	}
+}
+
+func TestAuthorizedKeyAllows(t *testing.T) {
+	keys, invalid := parseAuthorizedKeys([]byte(
+		`from="10.0.0.0/8,!10.0.0.1,192.168.1.1",expiry-time="20300101Z" ` + testAliceKey,
+	))
+	if len(invalid) != 0 {
+		t.Fatalf("unexpected invalid keys: %v", invalid)
+	}
+
+	key := keys[0]
+	now := time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		ip      string
+		now     time.Time
+		allowed bool
+	}{
+		{"10.1.2.3", now, true},
+		{"192.168.1.1", now, true},
+		{"10.0.0.1", now, false},
+		{"192.168.1.2", now, false},
+		{"10.1.2.3", now.AddDate(2, 0, 0), false},
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(tc.ip), Port: 2222}
+		if allowed := key.Allows(addr, tc.now); allowed != tc.allowed {
+			t.Errorf("Allows(%s, %s): expected %t, got %t",
+				tc.ip, tc.now, tc.allowed, allowed,
+			)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync/atomic"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+var errAccessDenied = errors.New("access denied")
+
+// Access is the level of access that an identity has to a repository.
+//
+type Access string
+
+const (
+	// AccessRead allows fetching and cloning (`git-upload-pack` and
+	// `git-upload-archive`).
+	//
+	AccessRead Access = "read"
+
+	// AccessWrite allows pushing (`git-receive-pack`), and implies
+	// AccessRead.
+	//
+	AccessWrite Access = "write"
+)
+
+// includes tells whether having `a` grants `other`.
+//
+func (a Access) includes(other Access) bool {
+	return a == other || a == AccessWrite
+}
+
+// access is the level of access required for running the service.
+//
+func (s gitService) access() Access {
+	if s == serviceReceivePack {
+		return AccessWrite
+	}
+
+	return AccessRead
+}
+
+// Policy maps identities to the repositories they can access.
+//
+// ```yaml
+// rules:
+//   - identities: [alice, "SHA256:ZGjYfc..."]
+//     repositories: ["team/*.git"]
+//     access: write
+//   - identities: ["*"]
+//     repositories: ["public/*"]
+//     access: read
+// ```
+//
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule grants `Access` to any of `Identities` (usernames, key names,
+// key fingerprints, or `*` for anyone - including anonymous clients) over
+// the repositories matching any of the `Repositories` globs (as in
+// `path.Match`, against names like `team/foo.git`).
+//
+type PolicyRule struct {
+	Identities   []string `json:"identities"`
+	Repositories []string `json:"repositories"`
+	Access       Access   `json:"access"`
+}
+
+// ParsePolicy parses a policy in either YAML or JSON.
+//
+func ParsePolicy(content []byte) (*Policy, error) {
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(content, policy); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	for idx, rule := range policy.Rules {
+		switch rule.Access {
+		case AccessRead, AccessWrite:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown access '%s' "+
+				"(expected read or write)", idx, rule.Access,
+			)
+		}
+
+		for _, pattern := range rule.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("rule %d: pattern '%s': %w",
+					idx, pattern, err,
+				)
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+// Allows tells whether any of the rules grants `identity` the `access` to
+// the repository named `repo`.
+//
+func (p *Policy) Allows(identity Identity, repo string, access Access) bool {
+	for _, rule := range p.Rules {
+		if rule.Access.includes(access) &&
+			rule.matchesIdentity(identity) &&
+			rule.matchesRepository(repo) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r PolicyRule) matchesIdentity(identity Identity) bool {
+	for _, candidate := range r.Identities {
+		switch candidate {
+		case "*":
+			return true
+		case "":
+			continue
+		case identity.Name, identity.Fingerprint:
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r PolicyRule) matchesRepository(repo string) bool {
+	for _, pattern := range r.Repositories {
+		if matched, _ := path.Match(pattern, repo); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authorizer decides whether identities can read from or write to
+// repositories according to a policy file, reloaded whenever it changes.
+//
+// A nil Authorizer allows everything.
+//
+type Authorizer struct {
+	PolicyFilepath string
+
+	logger  *log.Logger
+	policy  atomic.Value // *Policy
+	watcher *fileWatcher
+}
+
+// Load loads the policy for the first time, failing if it can't be parsed.
+//
+func (a *Authorizer) Load(ctx context.Context) error {
+	a.logger = log.From(ctx)
+	a.watcher = &fileWatcher{
+		Filepath: a.PolicyFilepath,
+		OnChange: a.setPolicy,
+	}
+
+	if err := a.watcher.Load(); err != nil {
+		return fmt.Errorf("load policy: %w", err)
+	}
+
+	return nil
+}
+
+// Run keeps the policy up to date with the file until the context is
+// cancelled.
+//
+func (a *Authorizer) Run(ctx context.Context) error {
+	a.watcher.Run(ctx)
+	return nil
+}
+
+// Allows tells whether `identity` has `access` to the repository named
+// `repo`.
+//
+func (a *Authorizer) Allows(identity Identity, repo string, access Access) bool {
+	if a == nil {
+		return true
+	}
+
+	policy, _ := a.policy.Load().(*Policy)
+	if policy == nil {
+		return false
+	}
+
+	return policy.Allows(identity, repo, access)
+}
+
+func (a *Authorizer) setPolicy(content []byte) error {
+	policy, err := ParsePolicy(content)
+	if err != nil {
+		return fmt.Errorf("parse policy: %w", err)
+	}
+
+	a.policy.Store(policy)
+	a.logger.WithField("rules", len(policy.Rules)).Info("loaded policy")
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		valid   bool
+	}{
+		{
+			name: "yaml",
+			content: `
+rules:
+  - identities: [alice]
+    repositories: ["team/*"]
+    access: write
+`,
+			valid: true,
+		},
+		{
+			name:    "json",
+			content: `{"rules": [{"identities": ["*"], "repositories": ["*"], "access": "read"}]}`,
+			valid:   true,
+		},
+		{
+			name:    "empty",
+			content: ``,
+			valid:   true,
+		},
+		{
+			name: "unknown access",
+			content: `
+rules:
+  - identities: [alice]
+    repositories: ["*"]
+    access: admin
+`,
+		},
+		{
+			name: "bad pattern",
+			content: `
+rules:
+  - identities: [alice]
+    repositories: ["team/[*"]
+    access: read
+`,
+		},
+		{
+			name: "unknown field",
+			content: `
+rules:
+  - identity: alice
+    repositories: ["*"]
+    access: read
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParsePolicy([]byte(tc.content))
+			if tc.valid && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !tc.valid && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestPolicyAllows(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+rules:
+  - identities: [alice, "SHA256:bob"]
+    repositories: ["team/*", "alice.git"]
+    access: write
+  - identities: [carol]
+    repositories: ["team/*"]
+    access: read
+  - identities: ["*"]
+    repositories: ["public/*"]
+    access: read
+`))
+	if err != nil {
+		t.Fatalf("parse policy: %s", err)
+	}
+
+	var (
+		alice     = Identity{Name: "alice"}
+		bob       = Identity{Name: "bobby", Fingerprint: "SHA256:bob"}
+		carol     = Identity{Name: "carol"}
+		anonymous = Identity{}
+	)
+
+	for _, tc := range []struct {
+		identity Identity
+		repo     string
+		access   Access
+		allowed  bool
+	}{
+		{alice, "team/foo.git", AccessWrite, true},
+		{alice, "team/foo.git", AccessRead, true},
+		{alice, "alice.git", AccessWrite, true},
+		{alice, "team/sub/foo.git", AccessRead, false},
+		{alice, "other.git", AccessRead, false},
+
+		{bob, "team/foo.git", AccessWrite, true},
+
+		{carol, "team/foo.git", AccessRead, true},
+		{carol, "team/foo.git", AccessWrite, false},
+
+		{anonymous, "public/foo.git", AccessRead, true},
+		{anonymous, "public/foo.git", AccessWrite, false},
+		{anonymous, "team/foo.git", AccessRead, false},
+		{carol, "public/foo.git", AccessRead, true},
+	} {
+		allowed := policy.Allows(tc.identity, tc.repo, tc.access)
+		if allowed != tc.allowed {
+			t.Errorf("Allows(%+v, %s, %s): expected %t, got %t",
+				tc.identity, tc.repo, tc.access, tc.allowed, allowed,
+			)
+		}
+	}
+}
+
+func TestPolicyAllowsEmptyIdentityEntries(t *testing.T) {
+	policy := &Policy{Rules: []PolicyRule{{
+		Identities:   []string{""},
+		Repositories: []string{"*"},
+		Access:       AccessWrite,
+	}}}
+
+	if policy.Allows(Identity{}, "foo.git", AccessRead) {
+		t.Fatal("expected an empty identity entry to match no one")
+	}
+}
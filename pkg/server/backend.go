@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"syscall"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+const (
+	// BackendExec runs git's services by executing the git binary.
+	//
+	BackendExec = "exec"
+
+	// BackendGoGit runs git's services in-process with go-git, not
+	// requiring a git binary.
+	//
+	BackendGoGit = "go-git"
+)
+
+// Backend implements git's side of serving repositories: creating them, and
+// running the services (`git-upload-pack` and `git-receive-pack`) that
+// clients ask for.
+//
+type Backend interface {
+	// Name is the name that the backend is selected with (e.g.,
+	// `go-git`).
+	//
+	Name() string
+
+	// Init initializes `dir`, an existing directory, as a bare
+	// repository.
+	//
+	Init(dir string) error
+
+	// Command prepares `service` to run against the repository at `dir`
+	// for a client that talks git's protocol over its standard input and
+	// output (as over ssh), with `env` as the environment of the git
+	// processes involved (if any).
+	//
+	Command(ctx context.Context, service gitService, dir string, env []string) ServiceCommand
+
+	// HTTPHandler serves git's http protocol, with `ghx` serving the
+	// routes that the backend doesn't handle itself.
+	//
+	HTTPHandler(ghx *githttpxfer.GitHTTPXfer) http.Handler
+}
+
+// ServiceCommand is a git service running for a client, exposing the same
+// interface as a process regardless of the backend actually running one.
+//
+type ServiceCommand interface {
+	StdinPipe() (io.WriteCloser, error)
+	StdoutPipe() (io.ReadCloser, error)
+	StderrPipe() (io.ReadCloser, error)
+	Start() error
+	Wait() error
+
+	// Signal delivers `sig` to the service (and whatever it started,
+	// like hooks) once started.
+	//
+	Signal(sig syscall.Signal) error
+}
+
+// NewBackend instantiates the backend named `name` (`exec` or `go-git`),
+// with `git` as the git executable for those that need one.
+//
+func NewBackend(name, git string) (Backend, error) {
+	switch name {
+	case BackendExec:
+		return &ExecBackend{GitExecutableFilepath: git}, nil
+	case BackendGoGit:
+		return &GoGitBackend{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown backend '%s' (expected %s or %s)",
+		name, BackendExec, BackendGoGit,
+	)
+}
+
+// ExecBackend runs git's services by executing the git binary (through
+// githttpxfer for http).
+//
+type ExecBackend struct {
+	GitExecutableFilepath string
+}
+
+func (b *ExecBackend) Name() string {
+	return BackendExec
+}
+
+func (b *ExecBackend) Init(dir string) error {
+	return initBareRepository(b.GitExecutableFilepath, dir)
+}
+
+func (b *ExecBackend) Command(ctx context.Context, service gitService, dir string, env []string) ServiceCommand {
+	cmd := exec.CommandContext(ctx,
+		b.GitExecutableFilepath,
+		service.Subcommand(), dir,
+	)
+	cmd.Env = env
+
+	// in a process group of its own so that signals reach the hooks that
+	// git runs too.
+	//
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	return &execCommand{cmd}
+}
+
+func (b *ExecBackend) HTTPHandler(ghx *githttpxfer.GitHTTPXfer) http.Handler {
+	return ghx
+}
+
+type execCommand struct {
+	*exec.Cmd
+}
+
+func (c *execCommand) Signal(sig syscall.Signal) error {
+	return syscall.Kill(-c.Process.Pid, sig)
+}
+
+// exitError is what services that don't run as processes fail with, letting
+// them exit with a status code like processes do.
+//
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("exit status %d: %s", e.code, e.err)
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// isExitError tells whether `err` is a service exiting unsuccessfully, as
+// opposed to failing to run at all.
+//
+func isExitError(err error) bool {
+	var execErr *exec.ExitError
+	var serviceErr *exitError
+
+	return errors.As(err, &execErr) || errors.As(err, &serviceErr)
+}
@@ -0,0 +1,711 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/utils/ioutil"
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+// goGitAgent is how the go-git backend identifies itself to clients.
+//
+const goGitAgent = "git-serve/go-git"
+
+var (
+	errUnsupportedService = errors.New("unsupported by the go-git backend")
+	errShallowUnsupported = errors.New("shallow clones are unsupported by the go-git backend")
+)
+
+// GoGitBackend runs git's services in-process with go-git, so that serving
+// repositories doesn't require a git binary.
+//
+// It speaks version 0 of git's protocol only (clients asking for v2 fall
+// back to it), without the capabilities that it doesn't implement (e.g.,
+// shallow clones, partial clone filters, or side-band progress), and
+// doesn't run hooks.
+//
+type GoGitBackend struct{}
+
+func (b *GoGitBackend) Name() string {
+	return BackendGoGit
+}
+
+// Init initializes a bare repository denying non-fast-forward pushes, as
+// `git init --shared` does for the exec backend.
+//
+func (b *GoGitBackend) Init(dir string) error {
+	repo, err := gogit.PlainInit(dir, true)
+	if err != nil {
+		return fmt.Errorf("plain init '%s': %w", dir, err)
+	}
+
+	cfg, err := repo.Config()
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	cfg.Raw.Section("receive").SetOption("denyNonFastforwards", "true")
+
+	if err := repo.SetConfig(cfg); err != nil {
+		return fmt.Errorf("set config: %w", err)
+	}
+
+	return nil
+}
+
+func (b *GoGitBackend) Command(ctx context.Context, service gitService, dir string, env []string) ServiceCommand {
+	return newGoGitCommand(ctx, func(ctx context.Context, r io.Reader, w io.Writer) error {
+		return b.serve(ctx, service, dir, r, w, true, false)
+	})
+}
+
+// HTTPHandler serves the advertisement of refs and the rpc calls of the
+// smart http protocol, leaving the dumb one to githttpxfer.
+//
+func (b *GoGitBackend) HTTPHandler(ghx *githttpxfer.GitHTTPXfer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo := repositoryFrom(r.Context())
+		if repo == nil {
+			ghx.ServeHTTP(w, r)
+			return
+		}
+
+		service := gitService(r.URL.Query().Get("service"))
+
+		switch {
+		case r.Method == http.MethodGet &&
+			strings.HasSuffix(r.URL.Path, "/info/refs") &&
+			(service == serviceUploadPack || service == serviceReceivePack):
+			b.serveAdvertisement(w, r, repo, service)
+
+		case r.Method == http.MethodPost &&
+			(strings.HasSuffix(r.URL.Path, "/"+string(serviceUploadPack)) ||
+				strings.HasSuffix(r.URL.Path, "/"+string(serviceReceivePack))):
+			b.serveRPC(w, r, repo, httpRequestService(r))
+
+		default:
+			ghx.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (b *GoGitBackend) serveAdvertisement(w http.ResponseWriter, r *http.Request, repo *repository, service gitService) {
+	var buf bytes.Buffer
+
+	e := pktline.NewEncoder(&buf)
+	if err := e.EncodeString("# service=" + string(service) + "\n"); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := e.Flush(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err := b.serve(r.Context(), service, repo.Directory, nil, &buf, true, true)
+	if err != nil {
+		log.From(r.Context()).WithError(err).
+			WithField("repository", repo.Name).
+			Error("advertise refs")
+
+		http.Error(w,
+			http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError,
+		)
+		return
+	}
+
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type",
+		fmt.Sprintf("application/x-%s-advertisement", service),
+	)
+	w.Write(buf.Bytes())
+}
+
+func (b *GoGitBackend) serveRPC(w http.ResponseWriter, r *http.Request, repo *repository, service gitService) {
+	if r.Header.Get("Content-Type") != fmt.Sprintf("application/x-%s-request", service) {
+		http.Error(w,
+			http.StatusText(http.StatusUnsupportedMediaType),
+			http.StatusUnsupportedMediaType,
+		)
+		return
+	}
+
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gzipReader.Close()
+
+		body = gzipReader
+	}
+
+	setNoCacheHeaders(w)
+	w.Header().Set("Content-Type",
+		fmt.Sprintf("application/x-%s-result", service),
+	)
+
+	err := b.serve(r.Context(), service, repo.Directory, body, w, false, true)
+	if err != nil {
+		log.From(r.Context()).WithError(err).
+			WithField("repository", repo.Name).
+			Error(string(service))
+	}
+}
+
+func setNoCacheHeaders(w http.ResponseWriter) {
+	w.Header().Set("Expires", "Fri, 01 Jan 1980 00:00:00 GMT")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Cache-Control", "no-cache, max-age=0, must-revalidate")
+}
+
+// serve runs `service` against the repository at `dir` with the client's
+// side of the protocol read from `r` and the server's written to `w`:
+// starting with the advertisement of refs if `advertise`, and going through
+// a single round of negotiation if `stateless` (as over http).
+//
+func (b *GoGitBackend) serve(ctx context.Context,
+	service gitService, dir string,
+	r io.Reader, w io.Writer,
+	advertise, stateless bool,
+) error {
+	sto := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	w = ioutil.NewContextWriter(ctx, w)
+
+	if r != nil {
+		r = ioutil.NewContextReader(ctx, r)
+	}
+
+	switch service {
+	case serviceUploadPack:
+		if advertise {
+			ar, err := advertisedReferences(sto, true,
+				capability.OFSDelta,
+			)
+			if err != nil {
+				return fmt.Errorf("advertised references: %w", err)
+			}
+
+			if err := ar.Encode(w); err != nil {
+				return fmt.Errorf("encode advertised references: %w", err)
+			}
+		}
+
+		if r == nil {
+			return nil
+		}
+
+		return uploadPack(sto, r, w, stateless)
+
+	case serviceReceivePack:
+		if advertise {
+			ar, err := advertisedReferences(sto, false,
+				capability.OFSDelta, capability.DeleteRefs, capability.ReportStatus,
+			)
+			if err != nil {
+				return fmt.Errorf("advertised references: %w", err)
+			}
+
+			if err := ar.Encode(w); err != nil {
+				return fmt.Errorf("encode advertised references: %w", err)
+			}
+		}
+
+		if r == nil {
+			return nil
+		}
+
+		return receivePack(sto, r, w)
+	}
+
+	return fmt.Errorf("%s: %w", service, errUnsupportedService)
+}
+
+// advertisedReferences gathers the refs of a repository to advertise,
+// along with where HEAD points to if `withHEAD`.
+//
+func advertisedReferences(sto *filesystem.Storage, withHEAD bool, capabilities ...capability.Capability) (*packp.AdvRefs, error) {
+	ar := packp.NewAdvRefs()
+
+	if err := ar.Capabilities.Set(capability.Agent, goGitAgent); err != nil {
+		return nil, fmt.Errorf("set agent: %w", err)
+	}
+
+	for _, c := range capabilities {
+		if err := ar.Capabilities.Set(c); err != nil {
+			return nil, fmt.Errorf("set %s: %w", c, err)
+		}
+	}
+
+	iter, err := sto.IterReferences()
+	if err != nil {
+		return nil, fmt.Errorf("iter references: %w", err)
+	}
+
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && ref.Name() != plumbing.HEAD {
+			ar.References[ref.Name().String()] = ref.Hash()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("for each reference: %w", err)
+	}
+
+	if !withHEAD {
+		return ar, nil
+	}
+
+	head, err := sto.Reference(plumbing.HEAD)
+	if err != nil {
+		if errors.Is(err, plumbing.ErrReferenceNotFound) {
+			return ar, nil
+		}
+
+		return nil, fmt.Errorf("reference HEAD: %w", err)
+	}
+
+	if head.Type() == plumbing.SymbolicReference {
+		hash, ok := ar.References[head.Target().String()]
+		if !ok {
+			// unborn - e.g., an empty repository.
+			return ar, nil
+		}
+
+		if err := ar.AddReference(head); err != nil {
+			return nil, fmt.Errorf("add HEAD: %w", err)
+		}
+
+		ar.Head = &hash
+		return ar, nil
+	}
+
+	hash := head.Hash()
+	ar.Head = &hash
+
+	return ar, nil
+}
+
+// uploadPack negotiates with the client what it's missing and sends it a
+// packfile with those objects, behaving like git-upload-pack does for
+// clients that don't make use of `multi_ack`.
+//
+func uploadPack(sto *filesystem.Storage, r io.Reader, w io.Writer, stateless bool) error {
+	scanner := pktline.NewScanner(r)
+
+	wants, capabilities, err := readWants(sto, scanner)
+	if err != nil {
+		return fmt.Errorf("read wants: %w", err)
+	}
+
+	if len(wants) == 0 {
+		// nothing wanted (e.g., `git ls-remote`).
+		return nil
+	}
+
+	haves, done, err := negotiate(sto, scanner, w, stateless)
+	if err != nil {
+		return fmt.Errorf("negotiate: %w", err)
+	}
+
+	if !done {
+		return nil
+	}
+
+	objects, err := revlist.Objects(sto, wants, haves)
+	if err != nil {
+		return fmt.Errorf("revlist objects: %w", err)
+	}
+
+	useRefDeltas := !capabilities.Supports(capability.OFSDelta)
+	if _, err := packfile.NewEncoder(w, sto, useRefDeltas).Encode(objects, 10); err != nil {
+		return fmt.Errorf("encode packfile: %w", err)
+	}
+
+	return nil
+}
+
+// readWants reads the objects that the client wants up to the flush that
+// ends them, along with the capabilities that it asked for.
+//
+func readWants(sto *filesystem.Storage, scanner *pktline.Scanner) ([]plumbing.Hash, *capability.List, error) {
+	var wants []plumbing.Hash
+	capabilities := capability.NewList()
+
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\n"))
+		if len(line) == 0 {
+			return wants, capabilities, nil
+		}
+
+		switch {
+		case bytes.HasPrefix(line, []byte("want ")):
+			fields := bytes.SplitN(bytes.TrimPrefix(line, []byte("want ")), []byte(" "), 2)
+
+			want, err := parseHash(fields[0])
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if len(wants) == 0 && len(fields) == 2 {
+				if err := capabilities.Decode(fields[1]); err != nil {
+					return nil, nil, fmt.Errorf("decode capabilities: %w", err)
+				}
+			}
+
+			if err := sto.HasEncodedObject(want); err != nil {
+				return nil, nil, fmt.Errorf("not our ref %s", want)
+			}
+
+			wants = append(wants, want)
+
+		case bytes.HasPrefix(line, []byte("shallow ")),
+			bytes.HasPrefix(line, []byte("deepen")):
+			return nil, nil, errShallowUnsupported
+
+		default:
+			return nil, nil, fmt.Errorf("unexpected line '%s'", line)
+		}
+	}
+
+	return nil, nil, scanner.Err()
+}
+
+// negotiate goes through the `have` lines that the client sends, telling
+// it about the first object in common (ACK) or that there's none (NAK)
+// at every flush, up to `done` - or to the first flush if `stateless`, as
+// http clients send what they have again in the next request.
+//
+func negotiate(sto *filesystem.Storage, scanner *pktline.Scanner, w io.Writer, stateless bool) ([]plumbing.Hash, bool, error) {
+	var common []plumbing.Hash
+	e := pktline.NewEncoder(w)
+
+	for scanner.Scan() {
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte("\n"))
+
+		switch {
+		case len(line) == 0, bytes.Equal(line, []byte("done")):
+			if len(common) == 0 {
+				if err := e.EncodeString("NAK\n"); err != nil {
+					return nil, false, err
+				}
+			}
+
+			if len(line) != 0 {
+				return common, true, nil
+			}
+
+			if stateless {
+				return nil, false, nil
+			}
+
+		case bytes.HasPrefix(line, []byte("have ")):
+			have, err := parseHash(bytes.TrimPrefix(line, []byte("have ")))
+			if err != nil {
+				return nil, false, err
+			}
+
+			if sto.HasEncodedObject(have) != nil {
+				continue
+			}
+
+			common = append(common, have)
+			if len(common) == 1 {
+				if err := e.Encodef("ACK %s\n", have); err != nil {
+					return nil, false, err
+				}
+			}
+
+		default:
+			return nil, false, fmt.Errorf("unexpected line '%s'", line)
+		}
+	}
+
+	return nil, false, scanner.Err()
+}
+
+// receivePack stores the objects that the client sends and updates the
+// refs that it asked for, reporting back on each of them if asked to.
+//
+func receivePack(sto *filesystem.Storage, r io.Reader, w io.Writer) error {
+	br := bufio.NewReader(r)
+
+	// clients with nothing to update (`Everything up-to-date`) send a
+	// flush, or nothing at all.
+	//
+	peek, err := br.Peek(4)
+	if errors.Is(err, io.EOF) || bytes.Equal(peek, pktline.FlushPkt) {
+		return nil
+	}
+
+	cfg, err := sto.Config()
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	denyNonFastForwards := cfg.Raw.Section("receive").
+		Option("denyNonFastforwards") == "true"
+
+	req := packp.NewReferenceUpdateRequest()
+	if err := req.Decode(br); err != nil {
+		return fmt.Errorf("decode update request: %w", err)
+	}
+
+	// a packfile only follows commands that create or update refs.
+	//
+	hasPackfile := false
+	for _, cmd := range req.Commands {
+		if cmd.Action() != packp.Delete {
+			hasPackfile = true
+		}
+	}
+
+	status := packp.NewReportStatus()
+	status.UnpackStatus = "ok"
+
+	var unpackErr error
+	if hasPackfile {
+		unpackErr = packfile.UpdateObjectStorage(sto, req.Packfile)
+		if unpackErr != nil {
+			status.UnpackStatus = unpackErr.Error()
+		}
+	}
+
+	for _, cmd := range req.Commands {
+		msg := "ok"
+
+		switch {
+		case unpackErr != nil:
+			msg = "n/a (unpacker error)"
+		default:
+			if err := updateReference(sto, cmd, denyNonFastForwards); err != nil {
+				msg = err.Error()
+			}
+		}
+
+		status.CommandStatuses = append(status.CommandStatuses, &packp.CommandStatus{
+			ReferenceName: cmd.Name,
+			Status:        msg,
+		})
+	}
+
+	if !req.Capabilities.Supports(capability.ReportStatus) {
+		return unpackErr
+	}
+
+	if err := status.Encode(w); err != nil {
+		return fmt.Errorf("encode report status: %w", err)
+	}
+
+	return unpackErr
+}
+
+// updateReference applies a single command of an update request, as long
+// as the ref is still where the client saw it (and, if
+// `denyNonFastForwards`, the commit it points to is an ancestor of the new
+// one).
+//
+func updateReference(sto *filesystem.Storage, cmd *packp.Command, denyNonFastForwards bool) error {
+	var old *plumbing.Reference
+
+	current, err := sto.Reference(cmd.Name)
+	switch {
+	case errors.Is(err, plumbing.ErrReferenceNotFound):
+		if cmd.Old != plumbing.ZeroHash {
+			return fmt.Errorf("stale info")
+		}
+	case err != nil:
+		return fmt.Errorf("failed to lock")
+	default:
+		if current.Hash() != cmd.Old {
+			return fmt.Errorf("stale info")
+		}
+
+		old = current
+	}
+
+	switch cmd.Action() {
+	case packp.Invalid:
+		return fmt.Errorf("invalid command")
+
+	case packp.Delete:
+		if err := sto.RemoveReference(cmd.Name); err != nil {
+			return fmt.Errorf("failed to delete")
+		}
+
+		return nil
+	}
+
+	if err := sto.HasEncodedObject(cmd.New); err != nil {
+		return fmt.Errorf("missing necessary objects")
+	}
+
+	if denyNonFastForwards && old != nil && !isFastForward(sto, cmd.Old, cmd.New) {
+		return fmt.Errorf("non-fast-forward")
+	}
+
+	if err := sto.CheckAndSetReference(
+		plumbing.NewHashReference(cmd.Name, cmd.New), old,
+	); err != nil {
+		return fmt.Errorf("failed to update ref")
+	}
+
+	return nil
+}
+
+// isFastForward tells whether moving a ref from `from` to `to` is a fast
+// forward, with refs to objects other than commits (e.g., tags) always
+// being considered one.
+//
+func isFastForward(sto *filesystem.Storage, from, to plumbing.Hash) bool {
+	fromCommit, err := object.GetCommit(sto, from)
+	if err != nil {
+		return true
+	}
+
+	toCommit, err := object.GetCommit(sto, to)
+	if err != nil {
+		return true
+	}
+
+	isAncestor, err := fromCommit.IsAncestor(toCommit)
+	if err != nil {
+		return false
+	}
+
+	return isAncestor
+}
+
+func parseHash(b []byte) (plumbing.Hash, error) {
+	if len(b) != 40 {
+		return plumbing.ZeroHash, fmt.Errorf("invalid object id '%s'", b)
+	}
+
+	hash := plumbing.NewHash(string(b))
+	if hash.String() != string(b) {
+		return plumbing.ZeroHash, fmt.Errorf("invalid object id '%s'", b)
+	}
+
+	return hash, nil
+}
+
+// goGitCommand runs a service with go-git in the background, exposing it
+// through pipes the way that a process would.
+//
+type goGitCommand struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	serve  func(ctx context.Context, r io.Reader, w io.Writer) error
+
+	stdinReader, stdoutReader, stderrReader *io.PipeReader
+	stdinWriter, stdoutWriter, stderrWriter *io.PipeWriter
+
+	mu     sync.Mutex
+	signal syscall.Signal
+	done   chan struct{}
+	err    error
+}
+
+func newGoGitCommand(ctx context.Context, serve func(context.Context, io.Reader, io.Writer) error) *goGitCommand {
+	c := &goGitCommand{
+		serve: serve,
+		done:  make(chan struct{}),
+	}
+
+	c.ctx, c.cancel = context.WithCancel(ctx)
+	c.stdinReader, c.stdinWriter = io.Pipe()
+	c.stdoutReader, c.stdoutWriter = io.Pipe()
+	c.stderrReader, c.stderrWriter = io.Pipe()
+
+	return c
+}
+
+func (c *goGitCommand) StdinPipe() (io.WriteCloser, error) {
+	return c.stdinWriter, nil
+}
+
+func (c *goGitCommand) StdoutPipe() (io.ReadCloser, error) {
+	return c.stdoutReader, nil
+}
+
+func (c *goGitCommand) StderrPipe() (io.ReadCloser, error) {
+	return c.stderrReader, nil
+}
+
+func (c *goGitCommand) Start() error {
+	go func() {
+		defer close(c.done)
+		defer c.cancel()
+
+		err := c.serve(c.ctx, c.stdinReader, c.stdoutWriter)
+
+		c.mu.Lock()
+		switch {
+		case c.signal != 0:
+			err = &exitError{
+				code: 128 + int(c.signal),
+				err:  fmt.Errorf("%s", c.signal),
+			}
+		case err != nil:
+			fmt.Fprintf(c.stderrWriter, "fatal: %s\n", err)
+			err = &exitError{code: 128, err: err}
+		}
+		c.mu.Unlock()
+
+		c.stdinReader.Close()
+		c.stdoutWriter.Close()
+		c.stderrWriter.Close()
+
+		c.err = err
+	}()
+
+	return nil
+}
+
+func (c *goGitCommand) Wait() error {
+	<-c.done
+	return c.err
+}
+
+// Signal stops the service, with any signal being as good as SIGKILL.
+//
+func (c *goGitCommand) Signal(sig syscall.Signal) error {
+	c.mu.Lock()
+	if c.signal == 0 {
+		c.signal = sig
+	}
+	c.mu.Unlock()
+
+	c.cancel()
+	c.stdinReader.CloseWithError(context.Canceled)
+
+	return nil
+}
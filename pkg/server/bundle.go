@@ -0,0 +1,428 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+const (
+	// BundleManifestFilename is the name of the file, at the root of an
+	// export, that lists the repositories and their bundles.
+	//
+	BundleManifestFilename = "manifest.json"
+
+	// BundleManifestVersion is the version of the format of the manifest
+	// (and layout of the export) written by ExportRepositories.
+	//
+	BundleManifestVersion = 1
+
+	bundlesDirectory = "repositories"
+)
+
+// BundleManifest describes an export of the repositories of a data
+// directory: one bundle per repository, along with what the refs pointed at
+// when the bundle got created so that an import can be verified.
+//
+type BundleManifest struct {
+	Version      int                `json:"version"`
+	CreatedAt    time.Time          `json:"createdAt"`
+	Repositories []BundleRepository `json:"repositories"`
+}
+
+type BundleRepository struct {
+	// Name is the name of the repository (e.g., `team/foo.git`).
+	//
+	Name string `json:"name"`
+
+	// Bundle is the path, relative to the manifest, of the bundle with
+	// the repository's refs - empty for repositories without any (as
+	// there's nothing to bundle).
+	//
+	Bundle string `json:"bundle,omitempty"`
+
+	// Head is the ref that HEAD points at (e.g., `refs/heads/main`).
+	//
+	Head string `json:"head,omitempty"`
+
+	// Refs maps each ref in the bundle to the object it points at.
+	//
+	Refs map[string]string `json:"refs,omitempty"`
+}
+
+// ExportRepositories writes a bundle for each bare repository under `root`
+// into `dir`, along with a manifest describing them, executing `git` to
+// bundle them.
+//
+func ExportRepositories(ctx context.Context, git, root, dir string) (*BundleManifest, error) {
+	logger := log.From(ctx)
+
+	names, err := listRepositories(root)
+	if err != nil {
+		return nil, fmt.Errorf("list repositories: %w", err)
+	}
+
+	manifest := &BundleManifest{
+		Version:      BundleManifestVersion,
+		CreatedAt:    time.Now().UTC(),
+		Repositories: []BundleRepository{},
+	}
+
+	for _, name := range names {
+		repo, err := resolveRepository(root, name)
+		if err != nil {
+			return nil, fmt.Errorf("resolve '%s': %w", name, err)
+		}
+
+		exported, err := exportRepository(git, repo, dir)
+		if err != nil {
+			return nil, fmt.Errorf("export '%s': %w", name, err)
+		}
+
+		logger.WithFields(log.Fields{
+			"repository": exported.Name,
+			"bundle":     exported.Bundle,
+			"refs":       len(exported.Refs),
+		}).Info("exported")
+
+		manifest.Repositories = append(manifest.Repositories, exported)
+	}
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	fpath := filepath.Join(dir, BundleManifestFilename)
+	if err := os.WriteFile(fpath, append(content, '\n'), 0644); err != nil {
+		return nil, fmt.Errorf("write '%s': %w", fpath, err)
+	}
+
+	return manifest, nil
+}
+
+func exportRepository(git string, repo *repository, dir string) (BundleRepository, error) {
+	exported := BundleRepository{
+		Name: repo.Name,
+		Head: symbolicHead(repo.Directory),
+	}
+
+	hasRefs, err := hasRefs(repo.Directory)
+	if err != nil {
+		return exported, err
+	}
+
+	if !hasRefs {
+		return exported, nil
+	}
+
+	exported.Bundle = bundlesDirectory + "/" + repo.Name + ".bundle"
+
+	fpath, err := filepath.Abs(filepath.Join(dir, filepath.FromSlash(exported.Bundle)))
+	if err != nil {
+		return exported, fmt.Errorf("abs: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fpath), 0755); err != nil {
+		return exported, fmt.Errorf("mkdir '%s': %w", filepath.Dir(fpath), err)
+	}
+
+	out, err := execAt(repo.Directory, git, "bundle", "create", "--quiet", fpath, "--all")
+	if err != nil {
+		return exported, fmt.Errorf("bundle create: %w: %s", err, out)
+	}
+
+	// taking the refs from the bundle rather than the repository so that
+	// they match what got bundled even if pushes happened in between.
+	//
+	exported.Refs, err = bundleRefs(git, repo.Directory, fpath)
+	if err != nil {
+		return exported, err
+	}
+
+	return exported, nil
+}
+
+// LoadBundleManifest loads the manifest of an export made by
+// ExportRepositories into `dir`.
+//
+func LoadBundleManifest(dir string) (*BundleManifest, error) {
+	fpath := filepath.Join(dir, BundleManifestFilename)
+
+	content, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("read '%s': %w", fpath, err)
+	}
+
+	manifest := &BundleManifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("unmarshal '%s': %w", fpath, err)
+	}
+
+	if manifest.Version != BundleManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d (expected %d)",
+			manifest.Version, BundleManifestVersion,
+		)
+	}
+
+	return manifest, nil
+}
+
+// ImportRepositories restores the repositories of an export made by
+// ExportRepositories into `root`, verifying that the refs of each one point
+// at what they did when exported.
+//
+// Repositories that already exist are not touched: importing them is an
+// error, so that an import never mixes with what's already there.
+//
+func ImportRepositories(ctx context.Context, git, dir, root string, manifest *BundleManifest, hooks *Hooks) error {
+	logger := log.From(ctx)
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("abs '%s': %w", dir, err)
+	}
+
+	for _, imported := range manifest.Repositories {
+		repo, err := resolveRepository(root, imported.Name)
+		if err != nil {
+			return fmt.Errorf("resolve '%s': %w", imported.Name, err)
+		}
+
+		isBare, err := isBareRepository(repo.Directory)
+		if err != nil {
+			return fmt.Errorf("is bare check: %w", err)
+		}
+
+		if isBare {
+			return fmt.Errorf("import '%s': %w", repo.Name, os.ErrExist)
+		}
+
+		if err := createRepositoryAtomically(git, repo, func(tmp string) error {
+			return importRepository(git, tmp, dir, imported)
+		}); err != nil {
+			return fmt.Errorf("import '%s': %w", repo.Name, err)
+		}
+
+		if err := hooks.Install(repo.Directory); err != nil {
+			return fmt.Errorf("install hooks '%s': %w", repo.Name, err)
+		}
+
+		logger.WithFields(log.Fields{
+			"repository": repo.Name,
+			"refs":       len(imported.Refs),
+		}).Info("imported")
+	}
+
+	return nil
+}
+
+func importRepository(git, repoDir, dir string, imported BundleRepository) error {
+	if imported.Bundle != "" {
+		fpath := filepath.Join(dir, filepath.FromSlash(imported.Bundle))
+		if err := ensureWithinRoot(dir, fpath); err != nil {
+			return err
+		}
+
+		if out, err := execAt(repoDir, git, "bundle", "verify", "--quiet", fpath); err != nil {
+			return fmt.Errorf("bundle verify '%s': %w: %s", imported.Bundle, err, out)
+		}
+
+		if out, err := execAt(repoDir, git, "fetch", "--quiet", fpath, "+refs/*:refs/*"); err != nil {
+			return fmt.Errorf("fetch '%s': %w: %s", imported.Bundle, err, out)
+		}
+	}
+
+	if imported.Head != "" {
+		if out, err := execAt(repoDir, git, "symbolic-ref", "HEAD", imported.Head); err != nil {
+			return fmt.Errorf("symbolic-ref HEAD '%s': %w: %s", imported.Head, err, out)
+		}
+	}
+
+	refs, err := repositoryRefs(repoDir)
+	if err != nil {
+		return err
+	}
+
+	return verifyRefs(imported.Refs, refs)
+}
+
+// verifyRefs makes sure that the refs of a repository are exactly the
+// expected ones, pointing at the expected objects.
+//
+func verifyRefs(expected, actual map[string]string) error {
+	mismatches := []string{}
+
+	for ref, obj := range expected {
+		switch got, found := actual[ref]; {
+		case !found:
+			mismatches = append(mismatches, ref+": missing")
+		case got != obj:
+			mismatches = append(mismatches,
+				fmt.Sprintf("%s: expected %s, got %s", ref, obj, got),
+			)
+		}
+	}
+
+	for ref := range actual {
+		if _, found := expected[ref]; !found {
+			mismatches = append(mismatches, ref+": unexpected")
+		}
+	}
+
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return fmt.Errorf("refs mismatch: %s", strings.Join(mismatches, "; "))
+	}
+
+	return nil
+}
+
+// listRepositories walks `root` looking for bare repositories, returning
+// their names.
+//
+func listRepositories(root string) ([]string, error) {
+	names := []string{}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+
+			return err
+		}
+
+		if !d.IsDir() || !strings.HasSuffix(path, ".git") {
+			return nil
+		}
+
+		isBare, err := isBareRepository(path)
+		if err != nil || !isBare {
+			return err
+		}
+
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return fmt.Errorf("rel '%s': %w", path, err)
+		}
+
+		names = append(names, filepath.ToSlash(name))
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk '%s': %w", root, err)
+	}
+
+	return names, nil
+}
+
+// symbolicHead is the ref that HEAD points at in the repository at `dir`,
+// or empty if HEAD is detached.
+//
+func symbolicHead(dir string) string {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return ""
+	}
+
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil || head.Type() != plumbing.SymbolicReference {
+		return ""
+	}
+
+	return head.Target().String()
+}
+
+func hasRefs(dir string) (bool, error) {
+	refs, err := repositoryRefs(dir)
+	if err != nil {
+		return false, err
+	}
+
+	return len(refs) > 0, nil
+}
+
+// repositoryRefs maps every ref of the repository at `dir` to the object it
+// points at, as `git for-each-ref` does (but without executing git, so that
+// it works with either backend).
+//
+func repositoryRefs(dir string) (map[string]string, error) {
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return nil, fmt.Errorf("plain open '%s': %w", dir, err)
+	}
+
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, fmt.Errorf("iter references: %w", err)
+	}
+
+	refs := map[string]string{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if !strings.HasPrefix(ref.Name().String(), "refs/") {
+			return nil
+		}
+
+		// symbolic refs show as what they point at, with dangling ones
+		// left out.
+		//
+		resolved, err := storer.ResolveReference(repo.Storer, ref.Name())
+		if err != nil {
+			return nil
+		}
+
+		refs[ref.Name().String()] = resolved.Hash().String()
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("for each reference: %w", err)
+	}
+
+	return refs, nil
+}
+
+// bundleRefs maps every ref in the bundle at `fpath` to the object it
+// points at (leaving HEAD out, as that's not a ref that gets fetched).
+//
+func bundleRefs(git, dir, fpath string) (map[string]string, error) {
+	out, err := execAt(dir, git, "bundle", "list-heads", fpath)
+	if err != nil {
+		return nil, fmt.Errorf("bundle list-heads: %w: %s", err, out)
+	}
+
+	refs := parseRefs(out)
+	delete(refs, "HEAD")
+
+	return refs, nil
+}
+
+func parseRefs(out []byte) map[string]string {
+	refs := map[string]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		refs[fields[1]] = fields[0]
+	}
+
+	return refs
+}
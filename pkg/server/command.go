@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/shlex"
+)
+
+// gitService is one of the git programs that a client is allowed to have
+// the server run on its behalf.
+//
+type gitService string
+
+const (
+	serviceUploadPack    gitService = "git-upload-pack"
+	serviceReceivePack   gitService = "git-receive-pack"
+	serviceUploadArchive gitService = "git-upload-archive"
+)
+
+var gitServices = map[gitService]bool{
+	serviceUploadPack:    true,
+	serviceReceivePack:   true,
+	serviceUploadArchive: true,
+}
+
+var (
+	errEmptyCommand       = errors.New("interactive shells are not supported")
+	errUnsupportedCommand = errors.New("unsupported command")
+)
+
+// gitCommand is the result of parsing the command that an SSH client asked
+// to have executed.
+//
+type gitCommand struct {
+	Service    gitService
+	Repository string
+}
+
+// parseGitCommand parses the raw command line sent by a client, accepting
+// only invocations of the git services in either their dashed
+// (`git-upload-pack 'foo.git'`) or subcommand (`git upload-pack 'foo.git'`)
+// spellings, always with a single repository argument.
+//
+func parseGitCommand(raw string) (*gitCommand, error) {
+	args, err := shlex.Split(raw)
+	if err != nil {
+		return nil, fmt.Errorf("split: %w", err)
+	}
+
+	if len(args) == 0 {
+		return nil, errEmptyCommand
+	}
+
+	if args[0] == "git" && len(args) > 1 {
+		args = append([]string{"git-" + args[1]}, args[2:]...)
+	}
+
+	service := gitService(args[0])
+	if !gitServices[service] {
+		return nil, fmt.Errorf("%w: '%s'", errUnsupportedCommand, args[0])
+	}
+
+	if len(args) != 2 {
+		return nil, fmt.Errorf("%w: '%s' expects exactly one repository argument",
+			errUnsupportedCommand, service,
+		)
+	}
+
+	if strings.HasPrefix(args[1], "-") {
+		return nil, fmt.Errorf("%w: '%s' is not a repository",
+			errUnsupportedCommand, args[1],
+		)
+	}
+
+	return &gitCommand{
+		Service:    service,
+		Repository: args[1],
+	}, nil
+}
+
+// Subcommand is the name of the service as a subcommand of the git
+// executable (e.g., `upload-pack` for `git-upload-pack`).
+//
+func (s gitService) Subcommand() string {
+	return strings.TrimPrefix(string(s), "git-")
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseGitCommand(t *testing.T) {
+	for _, tc := range []struct {
+		raw        string
+		service    gitService
+		repository string
+		err        error
+	}{
+		{
+			raw:        "git-upload-pack 'foo.git'",
+			service:    serviceUploadPack,
+			repository: "foo.git",
+		},
+		{
+			raw:        "git-receive-pack '/team/foo.git'",
+			service:    serviceReceivePack,
+			repository: "/team/foo.git",
+		},
+		{
+			raw:        "git-upload-archive foo.git",
+			service:    serviceUploadArchive,
+			repository: "foo.git",
+		},
+		{
+			raw:        `git-upload-pack "with space.git"`,
+			service:    serviceUploadPack,
+			repository: "with space.git",
+		},
+		{
+			raw:        "git upload-pack 'foo.git'",
+			service:    serviceUploadPack,
+			repository: "foo.git",
+		},
+		{
+			raw:        "git receive-pack 'foo.git'",
+			service:    serviceReceivePack,
+			repository: "foo.git",
+		},
+
+		{raw: "", err: errEmptyCommand},
+		{raw: "   ", err: errEmptyCommand},
+		{raw: "ls /", err: errUnsupportedCommand},
+		{raw: "git", err: errUnsupportedCommand},
+		{raw: "git log", err: errUnsupportedCommand},
+		{raw: "git-shell", err: errUnsupportedCommand},
+		{raw: "git-upload-pack", err: errUnsupportedCommand},
+		{raw: "git-upload-pack 'foo.git' 'bar.git'", err: errUnsupportedCommand},
+		{raw: "git upload-pack 'foo.git' extra", err: errUnsupportedCommand},
+		{raw: "git-upload-pack --help", err: errUnsupportedCommand},
+		{raw: "git-upload-pack '-foo.git'", err: errUnsupportedCommand},
+		{raw: "git upload-pack --upload-pack=touch", err: errUnsupportedCommand},
+	} {
+		t.Run(tc.raw, func(t *testing.T) {
+			command, err := parseGitCommand(tc.raw)
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Fatalf("expected error '%s', got '%v'", tc.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if command.Service != tc.service || command.Repository != tc.repository {
+				t.Fatalf("expected %s '%s', got %s '%s'",
+					tc.service, tc.repository,
+					command.Service, command.Repository,
+				)
+			}
+		})
+	}
+}
+
+func TestParseGitCommandUnbalancedQuotes(t *testing.T) {
+	if _, err := parseGitCommand("git-upload-pack 'foo.git"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// credentials maps usernames to the passwords they authenticate with over
+// HTTP.
+//
+type credentials map[string]storedPassword
+
+// parseCredentials parses an htpasswd-compatible credentials file: one
+// `username:password` pair per line, with passwords either hashed (bcrypt,
+// `{SHA}`, or SHA-256/512 crypt) or in plain text, and blank lines and lines
+// starting with `#` ignored.
+//
+func parseCredentials(content []byte) (credentials, error) {
+	creds := credentials{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		idx := strings.IndexByte(line, ':')
+		if idx <= 0 {
+			return nil, fmt.Errorf("line %d: expected 'username:password'", lineno)
+		}
+
+		password, err := parsePassword(line[idx+1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+
+		creds[line[:idx]] = password
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("scan: %w", err)
+	}
+
+	return creds, nil
+}
+
+// usernames lists, sorted, the users that have credentials.
+//
+func (c credentials) usernames() []string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// diffNames compares two sorted lists of names, returning those that are
+// only in `after` (added) and those that are only in `before` (removed).
+//
+func diffNames(before, after []string) (added, removed []string) {
+	beforeSet := make(map[string]bool, len(before))
+	for _, name := range before {
+		beforeSet[name] = true
+	}
+
+	afterSet := make(map[string]bool, len(after))
+	for _, name := range after {
+		afterSet[name] = true
+
+		if !beforeSet[name] {
+			added = append(added, name)
+		}
+	}
+
+	for _, name := range before {
+		if !afterSet[name] {
+			removed = append(removed, name)
+		}
+	}
+
+	return added, removed
+}
@@ -2,13 +2,23 @@ package server
 
 import (
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
 )
 
-func initDirAsBareRepository(dir string) error {
+// defaultDescription is the description that `git init` leaves in
+// repositories, standing for none.
+//
+const defaultDescription = "Unnamed repository;"
+
+func initDirAsBareRepository(dir string, backend Backend) error {
 	_, err := os.Stat(dir)
 	if err != nil {
 		if !os.IsNotExist(err) {
@@ -29,7 +39,7 @@ func initDirAsBareRepository(dir string) error {
 		return nil
 	}
 
-	err = initBareRepository(dir)
+	err = backend.Init(dir)
 	if err != nil {
 		return fmt.Errorf("init dir as bare repo: %w", err)
 	}
@@ -37,8 +47,8 @@ func initDirAsBareRepository(dir string) error {
 	return nil
 }
 
-func initBareRepository(dir string) error {
-	_, err := execAt(dir, "git", "init", "--bare", "--shared")
+func initBareRepository(git, dir string) error {
+	_, err := execAt(dir, git, "init", "--bare", "--shared")
 	if err != nil {
 		return fmt.Errorf("init bare '%s': %w", dir, err)
 	}
@@ -65,8 +75,201 @@ func isBareRepository(dir string) (bool, error) {
 	return false, nil
 }
 
+// repositoryDescription is the description of the repository at `dir` (the
+// `description` file that gitweb and others show), or empty if it has none.
+//
+func repositoryDescription(dir string) (string, error) {
+	fpath := filepath.Join(dir, "description")
+
+	fbytes, err := os.ReadFile(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("readfile '%s': %w", fpath, err)
+	}
+
+	description := strings.TrimSpace(string(fbytes))
+	if strings.HasPrefix(description, defaultDescription) {
+		return "", nil
+	}
+
+	return description, nil
+}
+
+func setRepositoryDescription(dir, description string) error {
+	fpath := filepath.Join(dir, "description")
+
+	if err := os.WriteFile(fpath, []byte(description+"\n"), 0644); err != nil {
+		return fmt.Errorf("writefile '%s': %w", fpath, err)
+	}
+
+	return nil
+}
+
+// setDefaultBranch points HEAD of the repository at `dir` to `branch`
+// (e.g., `main`), regardless of it existing yet.
+//
+func setDefaultBranch(dir, branch string) error {
+	if err := checkBranchName(branch); err != nil {
+		return fmt.Errorf("invalid branch name '%s': %w", branch, err)
+	}
+
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		return fmt.Errorf("plain open '%s': %w", dir, err)
+	}
+
+	err = repo.Storer.SetReference(plumbing.NewSymbolicReference(
+		plumbing.HEAD, plumbing.NewBranchReferenceName(branch),
+	))
+	if err != nil {
+		return fmt.Errorf("set HEAD: %w", err)
+	}
+
+	return nil
+}
+
+// checkBranchName checks `name` against the rules that git has for branch
+// names (as `git check-ref-format --branch` does).
+//
+func checkBranchName(name string) error {
+	switch {
+	case name == "" || name == "HEAD":
+		return fmt.Errorf("reserved name")
+	case strings.HasPrefix(name, "-"):
+		return fmt.Errorf("can't start with '-'")
+	case strings.HasSuffix(name, "."):
+		return fmt.Errorf("can't end with '.'")
+	case strings.Contains(name, ".."):
+		return fmt.Errorf("can't contain '..'")
+	case strings.Contains(name, "@{"):
+		return fmt.Errorf("can't contain '@{'")
+	case strings.ContainsAny(name, " ~^:?*[\\"):
+		return fmt.Errorf("can't contain spaces or any of '~^:?*[\\'")
+	}
+
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("can't contain control characters")
+		}
+	}
+
+	for _, component := range strings.Split(name, "/") {
+		switch {
+		case component == "":
+			return fmt.Errorf("can't have empty components")
+		case strings.HasPrefix(component, "."):
+			return fmt.Errorf("components can't start with '.'")
+		case strings.HasSuffix(component, ".lock"):
+			return fmt.Errorf("components can't end with '.lock'")
+		}
+	}
+
+	return nil
+}
+
+// lastRefUpdate is when the refs of the repository at `dir` last changed -
+// i.e., when it was last pushed to (or, for mirrors, synced) - going by the
+// modification times of loose refs, the directories they live in, and
+// `packed-refs`.
+//
+func lastRefUpdate(dir string) (time.Time, error) {
+	var last time.Time
+
+	info, err := os.Stat(filepath.Join(dir, "packed-refs"))
+	switch {
+	case err == nil:
+		last = info.ModTime()
+	case !os.IsNotExist(err):
+		return last, fmt.Errorf("stat packed-refs: %w", err)
+	}
+
+	err = filepath.WalkDir(filepath.Join(dir, "refs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return last, fmt.Errorf("walk refs: %w", err)
+	}
+
+	return last, nil
+}
+
 func execAt(dir string, name string, arg ...string) ([]byte, error) {
 	c := exec.Command(name, arg...)
 	c.Dir = dir
+	c.Env = gitEnv()
 	return c.CombinedOutput()
 }
+
+// inheritedVariables are the variables from git-serve's own environment
+// that git (and the hooks that it runs) get to see: what's needed to find
+// programs and files, format text, and reach remotes. The rest, such as
+// the GIT_SERVE_* variables that git-serve itself is configured with
+// (passwords included), are kept from them.
+//
+var inheritedVariables = []string{
+	"HOME", "LANG", "LANGUAGE", "LOGNAME", "PATH", "TMPDIR", "TZ", "USER",
+
+	"GIT_CONFIG_GLOBAL", "GIT_CONFIG_NOSYSTEM", "GIT_CONFIG_SYSTEM",
+	"GIT_EXEC_PATH", "GIT_SSL_CAINFO", "GIT_SSL_CAPATH", "GIT_TEMPLATE_DIR",
+	"SSL_CERT_DIR", "SSL_CERT_FILE",
+
+	"ALL_PROXY", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY",
+	"all_proxy", "http_proxy", "https_proxy", "no_proxy",
+}
+
+// inheritedPrefixes are, like inheritedVariables, prefixes of the names of
+// the variables that git gets to see.
+//
+var inheritedPrefixes = []string{"GIT_TRACE", "LC_"}
+
+// gitEnv is the environment for running git with: the inherited subset of
+// git-serve's own, plus `env`.
+//
+func gitEnv(env ...string) []string {
+	inherited := []string{}
+
+	for _, kv := range os.Environ() {
+		name := kv
+		if idx := strings.IndexByte(kv, '='); idx != -1 {
+			name = kv[:idx]
+		}
+
+		if isInheritedVariable(name) {
+			inherited = append(inherited, kv)
+		}
+	}
+
+	return append(inherited, env...)
+}
+
+func isInheritedVariable(name string) bool {
+	for _, variable := range inheritedVariables {
+		if name == variable {
+			return true
+		}
+	}
+
+	for _, prefix := range inheritedPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
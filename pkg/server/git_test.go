@@ -0,0 +1,86 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestCheckBranchName(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		valid bool
+	}{
+		{"main", true},
+		{"feature/foo", true},
+		{"release-1.0", true},
+		{"v1.0.0@1", true},
+		{"@", true},
+
+		{"", false},
+		{"HEAD", false},
+		{"-main", false},
+		{"main.", false},
+		{"feature/", false},
+		{"/main", false},
+		{"feature//foo", false},
+		{"foo..bar", false},
+		{"foo@{1}", false},
+		{"foo bar", false},
+		{"foo~1", false},
+		{"foo^", false},
+		{"foo:bar", false},
+		{"foo?", false},
+		{"foo*", false},
+		{"foo[", false},
+		{"foo\\bar", false},
+		{"foo\tbar", false},
+		{"foo\x7f", false},
+		{".hidden", false},
+		{"feature/.hidden", false},
+		{"main.lock", false},
+		{"main.lock/foo", false},
+	} {
+		err := checkBranchName(tc.name)
+		if tc.valid && err != nil {
+			t.Errorf("checkBranchName(%q): unexpected error: %s", tc.name, err)
+		}
+
+		if !tc.valid && err == nil {
+			t.Errorf("checkBranchName(%q): expected an error", tc.name)
+		}
+	}
+}
+
+func TestGitEnv(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin")
+	t.Setenv("LC_ALL", "C")
+	t.Setenv("GIT_TRACE_PACKET", "1")
+	t.Setenv("GIT_SERVE_HTTP_PASSWORD", "s3cr3t")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "s3cr3t")
+	t.Setenv("PATHS", "/nope")
+
+	env := map[string]bool{}
+	for _, kv := range gitEnv("GIT_SERVE_REPOSITORY=foo.git") {
+		env[kv] = true
+	}
+
+	for _, kv := range []string{
+		"PATH=/usr/bin",
+		"LC_ALL=C",
+		"GIT_TRACE_PACKET=1",
+		"GIT_SERVE_REPOSITORY=foo.git",
+	} {
+		if !env[kv] {
+			t.Errorf("expected '%s' in the environment", kv)
+		}
+	}
+
+	for _, kv := range []string{
+		"GIT_SERVE_HTTP_PASSWORD=s3cr3t",
+		"AWS_SECRET_ACCESS_KEY=s3cr3t",
+		"PATHS=/nope",
+	} {
+		if env[kv] {
+			t.Errorf("expected '%s' to not be in the environment", kv)
+		}
+	}
+}
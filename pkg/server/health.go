@@ -0,0 +1,192 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+	versionPath = "/version"
+
+	// readinessCheckTimeout bounds how long each readiness check can
+	// take, so that a hanging one doesn't hold up the probe.
+	//
+	readinessCheckTimeout = 5 * time.Second
+)
+
+// Health tells whether the server is alive (`/healthz`), whether it's
+// ready to serve git operations (`/readyz`: the data directory is
+// writable, git can be executed, and the ssh server is listening), and
+// which version it is (`/version`).
+//
+// Those endpoints are served by the http server regardless of
+// authentication so that they can be probed by orchestrators.
+//
+// A nil Health serves none of them.
+//
+type Health struct {
+	DataDirectory         string
+	GitExecutableFilepath string
+	Version               string
+
+	sshListening int32
+}
+
+// readinessCheck is the outcome of one of the checks that determine
+// readiness: empty when it passed.
+//
+type readinessCheck struct {
+	Name  string `json:"name"`
+	Error string `json:"error,omitempty"`
+}
+
+// setSSHListening marks whether the ssh server has its listener bound.
+//
+func (h *Health) setSSHListening(listening bool) {
+	if h == nil {
+		return
+	}
+
+	var value int32
+	if listening {
+		value = 1
+	}
+
+	atomic.StoreInt32(&h.sshListening, value)
+}
+
+// checks runs every readiness check, telling whether they all passed.
+//
+func (h *Health) checks(ctx context.Context) ([]readinessCheck, bool) {
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+
+	checks := []readinessCheck{
+		{Name: "data-dir"},
+		{Name: "git"},
+		{Name: "ssh"},
+	}
+
+	errs := []error{
+		h.checkDataDirectory(),
+		h.checkGit(ctx),
+		h.checkSSH(),
+	}
+
+	ready := true
+	for idx, err := range errs {
+		if err != nil {
+			checks[idx].Error = err.Error()
+			ready = false
+		}
+	}
+
+	return checks, ready
+}
+
+// checkDataDirectory verifies that repositories can be created in the
+// data directory by writing (and then removing) a file to it.
+//
+func (h *Health) checkDataDirectory() error {
+	if err := os.MkdirAll(h.DataDirectory, 0755); err != nil {
+		return fmt.Errorf("mkdir '%s': %w", h.DataDirectory, err)
+	}
+
+	file, err := os.CreateTemp(h.DataDirectory, ".readyz-")
+	if err != nil {
+		return fmt.Errorf("create temp in '%s': %w", h.DataDirectory, err)
+	}
+
+	file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return fmt.Errorf("remove '%s': %w", file.Name(), err)
+	}
+
+	return nil
+}
+
+// checkGit makes sure that git can be executed, unless there's none to
+// check for (e.g., with the go-git backend).
+//
+func (h *Health) checkGit(ctx context.Context) error {
+	if h.GitExecutableFilepath == "" {
+		return nil
+	}
+
+	out, err := exec.CommandContext(ctx,
+		h.GitExecutableFilepath, "--version",
+	).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s --version: %w: %s",
+			h.GitExecutableFilepath, err, out,
+		)
+	}
+
+	return nil
+}
+
+func (h *Health) checkSSH() error {
+	if atomic.LoadInt32(&h.sshListening) == 0 {
+		return fmt.Errorf("ssh server not listening")
+	}
+
+	return nil
+}
+
+// healthMiddleware serves the health, readiness, and version endpoints,
+// leaving everything else to the next handlers.
+//
+func (s *HTTPServer) healthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case healthzPath:
+			s.handleHealthz(w, r)
+		case readyzPath:
+			s.handleReadyz(w, r)
+		case versionPath:
+			s.handleVersion(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func (s *HTTPServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+func (s *HTTPServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks, ready := s.Health.checks(r.Context())
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+
+		s.logger.WithField("checks", checks).Warn("not ready")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Ready  bool             `json:"ready"`
+		Checks []readinessCheck `json:"checks"`
+	}{ready, checks})
+}
+
+func (s *HTTPServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Version string `json:"version"`
+		Go      string `json:"go"`
+	}{s.Health.Version, runtime.Version()})
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+const (
+	// TransportVariable is the name of the environment variable through
+	// which hooks get to know the transport (`http` or `ssh`) that the
+	// push came through.
+	//
+	TransportVariable = "GIT_SERVE_TRANSPORT"
+
+	// RepositoryVariable is the name of the environment variable through
+	// which hooks get to know the name of the repository being pushed to
+	// (e.g., `team/foo.git`).
+	//
+	RepositoryVariable = "GIT_SERVE_REPOSITORY"
+
+	// FingerprintVariable is the name of the environment variable through
+	// which hooks get to know the fingerprint of the key or certificate
+	// that the client authenticated with, if any.
+	//
+	FingerprintVariable = "GIT_SERVE_FINGERPRINT"
+)
+
+const (
+	transportHTTP = "http"
+	transportSSH  = "ssh"
+)
+
+// Hooks installs the executables in a directory as the server-side hooks
+// (`pre-receive`, `update`, `post-receive`, etc) of repositories, by
+// symlinking them into each repository's `hooks` directory.
+//
+// A nil Hooks installs nothing.
+//
+type Hooks struct {
+	Directory string
+}
+
+// InstallAll installs the hooks into every bare repository under `root`.
+//
+func (h *Hooks) InstallAll(ctx context.Context, root string) error {
+	if h == nil {
+		return nil
+	}
+
+	logger := log.From(ctx)
+	count := 0
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+
+			return err
+		}
+
+		if !d.IsDir() || !strings.HasSuffix(path, ".git") {
+			return nil
+		}
+
+		isBare, err := isBareRepository(path)
+		if err != nil {
+			return fmt.Errorf("is bare check: %w", err)
+		}
+
+		if !isBare {
+			return nil
+		}
+
+		if err := h.Install(path); err != nil {
+			return fmt.Errorf("install '%s': %w", path, err)
+		}
+
+		count++
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return fmt.Errorf("walk '%s': %w", root, err)
+	}
+
+	logger.WithFields(log.Fields{
+		"hooks-dir":    h.Directory,
+		"repositories": count,
+	}).Info("installed hooks")
+
+	return nil
+}
+
+// Install symlinks each executable in the hooks directory into the `hooks`
+// directory of the repository at `dir`, replacing whatever was there under
+// the same name, and removing links to hooks that no longer exist.
+//
+func (h *Hooks) Install(dir string) error {
+	if h == nil {
+		return nil
+	}
+
+	hooksDir, err := filepath.Abs(h.Directory)
+	if err != nil {
+		return fmt.Errorf("abs '%s': %w", h.Directory, err)
+	}
+
+	entries, err := os.ReadDir(hooksDir)
+	if err != nil {
+		return fmt.Errorf("read dir '%s': %w", hooksDir, err)
+	}
+
+	repoHooksDir := filepath.Join(dir, "hooks")
+	if err := os.MkdirAll(repoHooksDir, 0755); err != nil {
+		return fmt.Errorf("mkdir '%s': %w", repoHooksDir, err)
+	}
+
+	for _, entry := range entries {
+		src := filepath.Join(hooksDir, entry.Name())
+
+		info, err := os.Stat(src)
+		if err != nil {
+			return fmt.Errorf("stat '%s': %w", src, err)
+		}
+
+		if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+			continue
+		}
+
+		dst := filepath.Join(repoHooksDir, entry.Name())
+		if target, err := os.Readlink(dst); err == nil && target == src {
+			continue
+		}
+
+		if err := os.RemoveAll(dst); err != nil {
+			return fmt.Errorf("remove '%s': %w", dst, err)
+		}
+
+		if err := os.Symlink(src, dst); err != nil {
+			return fmt.Errorf("symlink '%s': %w", dst, err)
+		}
+	}
+
+	installed, err := os.ReadDir(repoHooksDir)
+	if err != nil {
+		return fmt.Errorf("read dir '%s': %w", repoHooksDir, err)
+	}
+
+	for _, entry := range installed {
+		dst := filepath.Join(repoHooksDir, entry.Name())
+
+		target, err := os.Readlink(dst)
+		if err != nil || filepath.Dir(target) != hooksDir {
+			continue
+		}
+
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			if err := os.Remove(dst); err != nil {
+				return fmt.Errorf("remove '%s': %w", dst, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// hookEnv is the environment that git commands run with on behalf of a
+// client, letting hooks know who's pushing, through which transport, and to
+// which repository - but nothing of git-serve's own configuration.
+//
+func hookEnv(identity Identity, transport string, repo *repository) []string {
+	name := identity.String()
+	if identity.IsAnonymous() {
+		name = ""
+	}
+
+	return gitEnv(
+		AuthorizedKeyIdentityVariable+"="+name,
+		FingerprintVariable+"="+identity.Fingerprint,
+		TransportVariable+"="+transport,
+		RepositoryVariable+"="+repo.Name,
+	)
+}
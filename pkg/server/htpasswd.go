@@ -0,0 +1,274 @@
+package server
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errMD5Password is the error for passwords hashed with Apache's MD5
+// (`$apr1$`), which is what `htpasswd` does unless told otherwise.
+//
+var errMD5Password = errors.New("unsupported hash scheme '$apr1$' (htpasswd's default, MD5): " +
+	"hash passwords with `htpasswd -B` (bcrypt), `-5` (SHA-256), or `-2` (SHA-512) instead")
+
+// storedPassword is a password as stored in an htpasswd-compatible file,
+// either in plain text or hashed, that a candidate can be verified against.
+//
+type storedPassword interface {
+	Verify(candidate string) bool
+}
+
+// parsePassword determines how a password from an htpasswd file is stored
+// (bcrypt, `{SHA}`, SHA-256/512 crypt, or plain text) based on its prefix.
+//
+func parsePassword(v string) (storedPassword, error) {
+	switch {
+	case strings.HasPrefix(v, "$2a$"),
+		strings.HasPrefix(v, "$2b$"),
+		strings.HasPrefix(v, "$2y$"):
+		if _, err := bcrypt.Cost([]byte(v)); err != nil {
+			return nil, fmt.Errorf("bcrypt: %w", err)
+		}
+
+		return bcryptPassword(v), nil
+	case strings.HasPrefix(v, "{SHA}"):
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, "{SHA}"))
+		if err != nil {
+			return nil, fmt.Errorf("sha: %w", err)
+		}
+
+		return shaPassword(digest), nil
+	case strings.HasPrefix(v, "$5$"), strings.HasPrefix(v, "$6$"):
+		return shaCryptPassword(v), nil
+	case strings.HasPrefix(v, "$apr1$"):
+		return nil, errMD5Password
+	case strings.HasPrefix(v, "$"):
+		scheme := strings.SplitN(v, "$", 3)[1]
+		return nil, fmt.Errorf("unsupported hash scheme '$%s$'", scheme)
+	}
+
+	return plainPassword(v), nil
+}
+
+type plainPassword string
+
+func (p plainPassword) Verify(candidate string) bool {
+	return subtle.ConstantTimeCompare([]byte(p), []byte(candidate)) == 1
+}
+
+type bcryptPassword string
+
+func (p bcryptPassword) Verify(candidate string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(p), []byte(candidate)) == nil
+}
+
+type shaPassword []byte
+
+func (p shaPassword) Verify(candidate string) bool {
+	digest := sha1.Sum([]byte(candidate))
+	return subtle.ConstantTimeCompare(p, digest[:]) == 1
+}
+
+type shaCryptPassword string
+
+func (p shaCryptPassword) Verify(candidate string) bool {
+	computed, err := shaCrypt(string(p), candidate)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(p), []byte(computed)) == 1
+}
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSaltLen    = 16
+	shaCryptAlphabet      = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// shaCryptByteOrder is the order in which the bytes of the final digest
+// are taken, three at a time, when encoding it.
+//
+var shaCryptByteOrder = map[string][]int{
+	"5": {
+		0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14,
+		15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29,
+		31, 30,
+	},
+	"6": {
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4,
+		47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51,
+		31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35,
+		15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19,
+		62, 20, 41, 63,
+	},
+}
+
+// shaCrypt computes the SHA-256 (`$5$`) or SHA-512 (`$6$`) crypt of
+// `candidate` using the parameters (scheme, rounds, and salt) from
+// `settings`, as specified in https://www.akkadia.org/drepper/SHA-crypt.txt.
+//
+func shaCrypt(settings, candidate string) (string, error) {
+	fields := strings.Split(settings, "$")
+	if len(fields) < 3 {
+		return "", fmt.Errorf("malformed sha-crypt settings")
+	}
+
+	scheme, fields := fields[1], fields[2:]
+
+	var newHash func() hash.Hash
+	switch scheme {
+	case "5":
+		newHash = sha256.New
+	case "6":
+		newHash = sha512.New
+	default:
+		return "", fmt.Errorf("unknown sha-crypt scheme '%s'", scheme)
+	}
+
+	prefix := "$" + scheme + "$"
+	rounds := shaCryptDefaultRounds
+
+	if strings.HasPrefix(fields[0], "rounds=") && len(fields) > 1 {
+		n, err := strconv.Atoi(strings.TrimPrefix(fields[0], "rounds="))
+		if err != nil {
+			return "", fmt.Errorf("rounds: %w", err)
+		}
+
+		switch {
+		case n < shaCryptMinRounds:
+			n = shaCryptMinRounds
+		case n > shaCryptMaxRounds:
+			n = shaCryptMaxRounds
+		}
+
+		rounds = n
+		prefix += "rounds=" + strconv.Itoa(n) + "$"
+		fields = fields[1:]
+	}
+
+	salt := []byte(fields[0])
+	if len(salt) > shaCryptMaxSaltLen {
+		salt = salt[:shaCryptMaxSaltLen]
+	}
+
+	key := []byte(candidate)
+	sum := func(parts ...[]byte) []byte {
+		h := newHash()
+		for _, part := range parts {
+			h.Write(part)
+		}
+
+		return h.Sum(nil)
+	}
+
+	// repeat produces `n` bytes by cycling through `b`.
+	repeat := func(b []byte, n int) []byte {
+		out := make([]byte, 0, n)
+		for len(out) < n {
+			out = append(out, b[:min(len(b), n-len(out))]...)
+		}
+
+		return out
+	}
+
+	alternate := sum(key, salt, key)
+
+	h := newHash()
+	h.Write(key)
+	h.Write(salt)
+	h.Write(repeat(alternate, len(key)))
+	for n := len(key); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(alternate)
+		} else {
+			h.Write(key)
+		}
+	}
+	digest := h.Sum(nil)
+
+	h = newHash()
+	for i := 0; i < len(key); i++ {
+		h.Write(key)
+	}
+	p := repeat(h.Sum(nil), len(key))
+
+	h = newHash()
+	for i := 0; i < 16+int(digest[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeat(h.Sum(nil), len(salt))
+
+	for i := 0; i < rounds; i++ {
+		h = newHash()
+
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(digest)
+		}
+
+		if i%3 != 0 {
+			h.Write(s)
+		}
+
+		if i%7 != 0 {
+			h.Write(p)
+		}
+
+		if i&1 != 0 {
+			h.Write(digest)
+		} else {
+			h.Write(p)
+		}
+
+		digest = h.Sum(nil)
+	}
+
+	return prefix + string(salt) + "$" +
+		shaCryptEncode(digest, shaCryptByteOrder[scheme]), nil
+}
+
+// shaCryptEncode encodes the digest with sha-crypt's base64 variant, taking
+// bytes in the given order, in groups of three (the last group possibly
+// being smaller).
+//
+func shaCryptEncode(digest []byte, order []int) string {
+	var sb strings.Builder
+
+	for i := 0; i < len(order); i += 3 {
+		group := order[i:min(i+3, len(order))]
+
+		var w uint
+		for _, idx := range group {
+			w = w<<8 | uint(digest[idx])
+		}
+
+		for n := len(group) + 1; n > 0; n-- {
+			sb.WriteByte(shaCryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+
+	return sb.String()
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// shaCryptVectors are the test vectors from
+// https://www.akkadia.org/drepper/SHA-crypt.txt.
+//
+var shaCryptVectors = []struct {
+	settings string
+	password string
+	expected string
+}{
+	{
+		"$5$saltstring",
+		"Hello world!",
+		"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+	},
+	{
+		"$5$rounds=10000$saltstringsaltstring",
+		"Hello world!",
+		"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA",
+	},
+	{
+		"$5$rounds=5000$toolongsaltstring",
+		"This is just a test",
+		"$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5",
+	},
+	{
+		"$5$rounds=1400$anotherlongsaltstring",
+		"a very much longer text to encrypt.  This one even stretches over morethan one line.",
+		"$5$rounds=1400$anotherlongsalts$Rx.j8H.h8HjEDGomFU8bDkXm3XIUnzyxf12oP84Bnq1",
+	},
+	{
+		"$5$rounds=77777$short",
+		"we have a short salt string but not a short password",
+		"$5$rounds=77777$short$JiO1O3ZpDAxGJeaDIuqCoEFysAe1mZNJRs3pw0KQRd/",
+	},
+	{
+		"$5$rounds=123456$asaltof16chars..",
+		"a short string",
+		"$5$rounds=123456$asaltof16chars..$gP3VQ/6X7UUEW3HkBn2w1/Ptq2jxPyzV/cZKmF/wJvD",
+	},
+	{
+		"$5$rounds=10$roundstoolow",
+		"the minimum number is still observed",
+		"$5$rounds=1000$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC",
+	},
+	{
+		"$6$saltstring",
+		"Hello world!",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+	},
+	{
+		"$6$rounds=10000$saltstringsaltstring",
+		"Hello world!",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+	},
+	{
+		"$6$rounds=5000$toolongsaltstring",
+		"This is just a test",
+		"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0",
+	},
+	{
+		"$6$rounds=1400$anotherlongsaltstring",
+		"a very much longer text to encrypt.  This one even stretches over morethan one line.",
+		"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1",
+	},
+	{
+		"$6$rounds=77777$short",
+		"we have a short salt string but not a short password",
+		"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0",
+	},
+	{
+		"$6$rounds=123456$asaltof16chars..",
+		"a short string",
+		"$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1",
+	},
+	{
+		"$6$rounds=10$roundstoolow",
+		"the minimum number is still observed",
+		"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX.",
+	},
+}
+
+func TestShaCrypt(t *testing.T) {
+	for _, tc := range shaCryptVectors {
+		computed, err := shaCrypt(tc.settings, tc.password)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.settings, err)
+			continue
+		}
+
+		if computed != tc.expected {
+			t.Errorf("%s: expected '%s', got '%s'", tc.settings, tc.expected, computed)
+		}
+	}
+}
+
+func TestParsePasswordVerify(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		stored   string
+		password string
+	}{
+		{"plain", "s3cr3t", "s3cr3t"},
+		{"sha", "{SHA}JauGvtFJymypwcDV23yakTiN3qs=", "s3cr3t"},
+		{"bcrypt 2a", "$2a$04$K1Txkf9ITZlJ1gokFv7nA.CigUpl/X1EF1A1ggwkrix1AMRVKT.ti", "s3cr3t"},
+		{"bcrypt 2y", "$2y$04$K1Txkf9ITZlJ1gokFv7nA.CigUpl/X1EF1A1ggwkrix1AMRVKT.ti", "s3cr3t"},
+		{"sha256 crypt", shaCryptVectors[0].expected, shaCryptVectors[0].password},
+		{"sha512 crypt", shaCryptVectors[7].expected, shaCryptVectors[7].password},
+		{"sha512 crypt with rounds", shaCryptVectors[8].expected, shaCryptVectors[8].password},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			password, err := parsePassword(tc.stored)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !password.Verify(tc.password) {
+				t.Errorf("expected '%s' to verify", tc.password)
+			}
+
+			for _, wrong := range []string{"", "wrong", tc.password + "!", strings.ToUpper(tc.password)} {
+				if password.Verify(wrong) {
+					t.Errorf("expected '%s' to not verify", wrong)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePasswordMD5(t *testing.T) {
+	_, err := parsePassword("$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/")
+	if !errors.Is(err, errMD5Password) {
+		t.Fatalf("expected an md5 error, got '%v'", err)
+	}
+
+	if !strings.Contains(err.Error(), "-B") {
+		t.Fatalf("expected the error to tell how to hash the password, got '%s'", err)
+	}
+}
+
+func TestParseCredentials(t *testing.T) {
+	creds, err := parseCredentials([]byte(`
+# the team
+alice:s3cr3t
+
+bob:{SHA}JauGvtFJymypwcDV23yakTiN3qs=
+`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if names := creds.usernames(); strings.Join(names, ",") != "alice,bob" {
+		t.Fatalf("expected alice and bob, got %v", names)
+	}
+
+	if !creds["bob"].Verify("s3cr3t") {
+		t.Fatal("expected bob's password to verify")
+	}
+}
+
+func TestParseCredentialsMalformed(t *testing.T) {
+	for _, line := range []string{
+		"alice",
+		":s3cr3t",
+		"alice:{SHA}not base64",
+		"alice:$2y$04$tooshort",
+		"alice:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/",
+		"alice:$1$saltsalt$2vnaRpHa6Jxjz5n83ok8Z0",
+	} {
+		if _, err := parseCredentials([]byte("bob:s3cr3t\n" + line + "\n")); err == nil {
+			t.Errorf("%s: expected an error", line)
+		} else if !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%s: expected the error to point at line 2, got '%s'", line, err)
+		}
+	}
+}
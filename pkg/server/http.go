@@ -2,9 +2,13 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/nulab/go-git-http-xfer/githttpxfer"
@@ -19,24 +23,52 @@ const (
 )
 
 type HTTPServer struct {
+	AccessLog             *AccessLog
+	Authorizer            *Authorizer
+	AutoCreate            AutoCreatePolicy
+	Backend               Backend
 	BindAddress           string
+	CredentialsFilepath   string
 	DataDirectory         string
 	GitExecutableFilepath string
+	Health                *Health
+	Hooks                 *Hooks
+	Mirrors               *Mirrors
 	NoAuth                bool
+	Notifier              *Notifier
 	Password              string
+	PushMirrors           *PushMirrors
+	ShutdownTimeout       time.Duration
+	TLSCertFilepath       string
+	TLSClientCAFilepath   string
+	TLSKeyFilepath        string
+	TLSRequireClientCert  bool
+	TLSSelfSigned         bool
+	TokensFilepath        string
 	Username              string
 
-	logger *log.Logger
+	logger      *log.Logger
+	operations  inflight
+	sizes       sizeCache
+	certificate atomic.Value // *tls.Certificate
+	credentials atomic.Value // credentials
+	tokens      atomic.Value // *Tokens
+	watchers    []*fileWatcher
 }
 
 func (s *HTTPServer) Run(ctx context.Context) error {
 	s.logger = log.From(ctx)
 
 	s.logger.WithFields(log.Fields{
-		"bind-addr": s.BindAddress,
-		"data-dir":  s.DataDirectory,
-		"git":       s.GitExecutableFilepath,
-		"no-auth":   s.NoAuth,
+		"auto-create": s.AutoCreate,
+		"backend":     s.Backend.Name(),
+		"bind-addr":   s.BindAddress,
+		"credentials": s.CredentialsFilepath,
+		"data-dir":    s.DataDirectory,
+		"git":         s.GitExecutableFilepath,
+		"no-auth":     s.NoAuth,
+		"tls":         s.tlsEnabled(),
+		"tokens":      s.TokensFilepath,
 	}).Info("starting")
 	defer s.logger.Info("finished")
 
@@ -45,29 +77,39 @@ func (s *HTTPServer) Run(ctx context.Context) error {
 		return fmt.Errorf("server: %w", err)
 	}
 
+	for _, watcher := range s.watchers {
+		go watcher.Run(ctx)
+	}
+
 	doneCh := make(chan error, 1)
 	go func() {
+		if server.TLSConfig != nil {
+			doneCh <- server.ListenAndServeTLS("", "")
+			return
+		}
+
 		doneCh <- server.ListenAndServe()
 	}()
 
 	select {
 	case <-ctx.Done():
-		return server.Shutdown(ctx)
+		return drain(s.logger, s.ShutdownTimeout, &s.operations,
+			server.Shutdown, server.Close,
+		)
 	case err := <-doneCh:
 		return err
 	}
 }
 
 func (s *HTTPServer) onRouteMatch(xferCtxt githttpxfer.Context) {
-	repositoryDirectory := filepath.Join(
-		s.DataDirectory,
-		xferCtxt.RepoPath(),
-	)
+	ctx := xferCtxt.Request().Context()
+	repo := repositoryFrom(ctx)
 
-	err := initDirAsBareRepository(repositoryDirectory)
-	if err != nil {
-		panic(err)
-	}
+	xferCtxt.SetRepoPath(repo.Name)
+	xferCtxt.SetEnv(append(
+		hookEnv(identityFrom(ctx), transportHTTP, repo),
+		gitServiceEnv(xferCtxt.Request().Header.Get(gitProtocolHeader))...,
+	))
 }
 
 func (s *HTTPServer) server() (*http.Server, error) {
@@ -79,56 +121,260 @@ func (s *HTTPServer) server() (*http.Server, error) {
 	ghx.Event.On(githttpxfer.AfterMatchRouting, s.onRouteMatch)
 
 	middlewares := []middleware{
+		s.operationMiddleware,
+		s.pushMiddleware,
+		s.repositoryMiddleware(ghx),
+		s.apiMiddleware(ghx),
+		s.adminMiddleware,
 		s.loggingMiddleware,
 	}
 
 	if !s.NoAuth {
 		s.logger.Info("auth enabled")
+
+		if s.CredentialsFilepath != "" {
+			watcher := &fileWatcher{
+				Filepath: s.CredentialsFilepath,
+				OnChange: s.setCredentials,
+			}
+
+			if err := watcher.Load(); err != nil {
+				return nil, fmt.Errorf("load credentials: %w", err)
+			}
+
+			s.watchers = append(s.watchers, watcher)
+		}
+
+		if s.TokensFilepath != "" {
+			watcher := &fileWatcher{
+				Filepath: s.TokensFilepath,
+				OnChange: s.setTokens,
+			}
+
+			if err := watcher.Load(); err != nil {
+				return nil, fmt.Errorf("load tokens: %w", err)
+			}
+
+			s.watchers = append(s.watchers, watcher)
+		}
+
 		middlewares = append(middlewares, s.authzMiddleware)
 	}
 
-	return &http.Server{
+	if s.Health != nil {
+		middlewares = append(middlewares, s.healthMiddleware)
+	}
+
+	server := &http.Server{
 		Addr: s.BindAddress,
 		Handler: newMiddlewareChain(
-			ghx,
+			s.Backend.HTTPHandler(ghx),
 			middlewares...,
 		),
-	}, nil
+	}
+
+	if s.tlsEnabled() {
+		server.TLSConfig, err = s.tlsConfig()
+		if err != nil {
+			return nil, fmt.Errorf("tls config: %w", err)
+		}
+	}
+
+	return server, nil
 }
 
 func (s *HTTPServer) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		t1 := time.Now()
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, r.WithContext(
+			log.WithLogger(r.Context(), s.logger),
+		))
 		t2 := time.Now()
 
 		s.logger.WithFields(log.Fields{
 			"method":   r.Method,
 			"url":      r.URL.String(),
+			"identity": identityFrom(r.Context()),
 			"duration": t2.Sub(t1),
 		}).Debug("req")
 	})
 }
 
-func (s *HTTPServer) authzMiddleware(next http.Handler) http.Handler {
+// repositoryMiddleware resolves the repository that a request targets to
+// a directory under the data directory, rejecting those that can't be
+// confined to it or that the identity isn't authorized to access before
+// they ever reach githttpxfer, and creating it according to the
+// auto-create policy.
+//
+func (s *HTTPServer) repositoryMiddleware(ghx *githttpxfer.GitHTTPXfer) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			match, _, err := ghx.Router.Match(r.Method, r.URL)
+			if err != nil {
+				// not a git route - let githttpxfer render it.
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			service := httpRequestService(r)
+			identity := identityFrom(r.Context())
+			token := tokenFrom(r.Context())
+
+			repo, err := resolveRepository(s.DataDirectory, match.RepoPath)
+			if err != nil {
+				s.logger.WithError(err).
+					WithField("url", r.URL.String()).
+					Debug("resolve repository")
+
+				s.rejectRequest(w, r, service, match.RepoPath,
+					err.Error(), http.StatusBadRequest,
+				)
+				return
+			}
+
+			if !s.Authorizer.Allows(identity, repo.Name, service.access()) ||
+				(token != nil && !token.Allows(repo.Name, service.access())) {
+				s.logger.WithFields(log.Fields{
+					"identity":   identity,
+					"repository": repo.Name,
+					"service":    service,
+				}).Info("access denied")
+				recordAuthAttempt(transportHTTP, authOutcomeDenied)
+
+				s.rejectRequest(w, r, service, repo.Name,
+					fmt.Sprintf("%s: %s", errAccessDenied, repo.Name),
+					http.StatusForbidden,
+				)
+				return
+			}
+
+			policy, err := s.Mirrors.openPolicy(repo.Name, service, s.AutoCreate)
+			if err != nil {
+				s.rejectRequest(w, r, service, repo.Name,
+					err.Error(), http.StatusForbidden,
+				)
+				return
+			}
+
+			err = openRepository(repo, service, policy, s.Hooks, s.Backend)
+			if err != nil {
+				if errors.Is(err, errRepositoryNotFound) {
+					s.rejectRequest(w, r, service, repo.Name,
+						err.Error(), http.StatusNotFound,
+					)
+					return
+				}
+
+				s.logger.WithError(err).
+					WithField("repository", repo.Name).
+					Error("open repository")
+
+				s.rejectRequest(w, r, service, repo.Name,
+					http.StatusText(http.StatusInternalServerError),
+					http.StatusInternalServerError,
+				)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(
+				withRepository(r.Context(), repo),
+			))
+		})
+	}
+}
+
+// rejectRequest responds with an error to a git request that won't ever
+// get to git, recording it in the access log.
+//
+func (s *HTTPServer) rejectRequest(w http.ResponseWriter, r *http.Request, service gitService, repository, msg string, code int) {
+	s.AccessLog.recordRejection(transportHTTP, service, repository,
+		identityFrom(r.Context()), r.RemoteAddr, code,
+	)
+	http.Error(w, msg, code)
+}
+
+// operationMiddleware records the metrics and access log entries of
+// requests that are part of git operations.
+//
+func (s *HTTPServer) operationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		username, password, ok := r.BasicAuth()
-		if !ok || username != s.Username || password != s.Password {
-			w.Header().Set(
-				"WWW-Authenticate",
-				`Basic realm="Please enter your username and password."`,
-			)
+		repo := repositoryFrom(r.Context())
+		if repo == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		op := startOperation(transportHTTP, httpRequestService(r), repo,
+			identityFrom(r.Context()), r.RemoteAddr,
+		)
 
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
-			w.Header().Set("Content-Type", "text/plain")
+		// githttpxfer sends SIGTERM to the git process (group) once the
+		// request's context is done, so that's what stands for any signal
+		// - with no handle on the process for a SIGKILL, stragglers are
+		// left to closing the connection.
+		//
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		defer s.operations.track(op, func(syscall.Signal) { cancel() })()
 
+		r = r.WithContext(ctx)
+		mw := &meteredResponseWriter{ResponseWriter: w, op: op}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{op.reader(r.Body), r.Body}
+
+		defer func() {
+			if mw.status == 0 {
+				mw.status = http.StatusOK
+			}
+
+			op.finish(mw.status)
+			s.AccessLog.record(op, mw.status)
+		}()
+
+		next.ServeHTTP(mw, r)
+	})
+}
+
+// pushMiddleware notifies webhooks of the refs that a push
+// (`git-receive-pack` rpc call) updated once it's done, and replicates the
+// repository to its push mirrors.
+//
+func (s *HTTPServer) pushMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost ||
+			!strings.HasSuffix(r.URL.Path, "/"+string(serviceReceivePack)) {
+			next.ServeHTTP(w, r)
 			return
 		}
+
+		ctx := r.Context()
+		tracker := s.Notifier.track(
+			repositoryFrom(ctx), identityFrom(ctx), transportHTTP,
+		)
+
+		mirrorTracker := s.PushMirrors.track(repositoryFrom(ctx))
+
 		next.ServeHTTP(w, r)
+		tracker.done()
+		mirrorTracker.done()
 	})
 }
 
+// httpRequestService determines which git service a smart (or dumb) HTTP
+// request is part of: either the `git-receive-pack` rpc call or its ref
+// advertisement for a push, or `git-upload-pack` for anything else.
+//
+func httpRequestService(r *http.Request) gitService {
+	if strings.HasSuffix(r.URL.Path, "/"+string(serviceReceivePack)) ||
+		r.URL.Query().Get("service") == string(serviceReceivePack) {
+		return serviceReceivePack
+	}
+
+	return serviceUploadPack
+}
+
 type middleware func(http.Handler) http.Handler
 
 func newMiddlewareChain(handler http.Handler, fns ...middleware) http.Handler {
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// adminPathPrefix is the prefix of the paths under which git-serve's own
+// endpoints live, apart from those of the repositories.
+//
+const adminPathPrefix = "/_git-serve/"
+
+// adminMiddleware routes requests for git-serve's own endpoints (and the
+// web ui, which `/` redirects to) to them, leaving everything else to the
+// git handlers.
+//
+func (s *HTTPServer) adminMiddleware(next http.Handler) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPathPrefix+"webhooks/deliveries", s.handleDeliveries)
+	mux.HandleFunc(adminPathPrefix+"mirrors", s.handleMirrors)
+	mux.HandleFunc(adminPathPrefix+"push-mirrors", s.handlePushMirrors)
+	mux.HandleFunc(uiPathPrefix, s.handleUI)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" && r.Method == http.MethodGet {
+			http.Redirect(w, r, uiPathPrefix, http.StatusFound)
+			return
+		}
+
+		if !strings.HasPrefix(r.URL.Path, adminPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleDeliveries lists the webhook deliveries (most recent first) for
+// the repositories that the client can read from, optionally filtered by
+// `?repository=<name>` and `?status=<pending|delivered|failed>`.
+//
+func (s *HTTPServer) handleDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w,
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	var (
+		identity   = identityFrom(r.Context())
+		token      = tokenFrom(r.Context())
+		repository = r.URL.Query().Get("repository")
+		status     = DeliveryStatus(r.URL.Query().Get("status"))
+	)
+
+	if repository != "" {
+		normalized, err := normalizeRepositoryName(repository)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		repository = normalized
+	}
+
+	deliveries := s.Notifier.Deliveries(func(repo string) bool {
+		return (repository == "" || repo == repository) &&
+			s.Authorizer.Allows(identity, repo, AccessRead) &&
+			(token == nil || token.Allows(repo, AccessRead))
+	})
+
+	if status != "" {
+		filtered := []Delivery{}
+		for _, delivery := range deliveries {
+			if delivery.Status == status {
+				filtered = append(filtered, delivery)
+			}
+		}
+
+		deliveries = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Deliveries []Delivery `json:"deliveries"`
+	}{deliveries})
+}
+
+// handleMirrors lists the status of the mirrors that the client can read
+// from.
+//
+func (s *HTTPServer) handleMirrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w,
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	var (
+		identity = identityFrom(r.Context())
+		token    = tokenFrom(r.Context())
+	)
+
+	mirrors := s.Mirrors.Statuses(func(repo string) bool {
+		return s.Authorizer.Allows(identity, repo, AccessRead) &&
+			(token == nil || token.Allows(repo, AccessRead))
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Mirrors []MirrorStatus `json:"mirrors"`
+	}{mirrors})
+}
+
+// handlePushMirrors lists the status of the push mirrors of the
+// repositories that the client can read from.
+//
+func (s *HTTPServer) handlePushMirrors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w,
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	var (
+		identity = identityFrom(r.Context())
+		token    = tokenFrom(r.Context())
+	)
+
+	pushMirrors := s.PushMirrors.Statuses(func(repo string) bool {
+		return s.Authorizer.Allows(identity, repo, AccessRead) &&
+			(token == nil || token.Allows(repo, AccessRead))
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		PushMirrors []PushMirrorStatus `json:"pushMirrors"`
+	}{pushMirrors})
+}
@@ -0,0 +1,631 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+// apiReposPath is the path of the collection of repositories in the
+// management api, with each one under `<apiReposPath>/<name>`.
+//
+const apiReposPath = "/api/v1/repos"
+
+var errRepositoryExists = errors.New("repository already exists")
+
+// RepositoryInfo describes a repository served by git-serve.
+//
+type RepositoryInfo struct {
+	Name          string `json:"name"`
+	Description   string `json:"description"`
+	DefaultBranch string `json:"defaultBranch"`
+	Mirror        bool   `json:"mirror"`
+
+	// Size is the size, in bytes, of the files of the repository.
+	//
+	Size int64 `json:"size"`
+
+	// LastPushAt is when the refs of the repository last changed, if
+	// it has any.
+	//
+	LastPushAt *time.Time `json:"lastPushAt,omitempty"`
+
+	// Refs maps each ref to the object that it points at (only set when
+	// describing a single repository).
+	//
+	Refs map[string]string `json:"refs,omitempty"`
+}
+
+// repositoryRequest is the body of requests creating (POST) or updating
+// (PATCH) a repository, with nil fields left untouched.
+//
+type repositoryRequest struct {
+	Name          *string `json:"name"`
+	Description   *string `json:"description"`
+	DefaultBranch *string `json:"defaultBranch"`
+}
+
+// apiMiddleware serves the repository management api, leaving everything
+// else (including the git routes of repositories that happen to live under
+// `api/`) to the git handlers.
+//
+func (s *HTTPServer) apiMiddleware(ghx *githttpxfer.GitHTTPXfer) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != apiReposPath &&
+				!strings.HasPrefix(r.URL.Path, apiReposPath+"/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if _, _, err := ghx.Router.Match(r.Method, r.URL); err == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			name := strings.TrimPrefix(
+				strings.TrimPrefix(r.URL.Path, apiReposPath), "/",
+			)
+
+			// without authentication, anyone could create, rename or
+			// delete repositories - so only reads are served.
+			//
+			if s.NoAuth && r.Method != http.MethodGet {
+				http.Error(w,
+					"repository management requires authentication "+
+						"(-http-no-auth is set)",
+					http.StatusForbidden,
+				)
+				return
+			}
+
+			switch {
+			case name == "" && r.Method == http.MethodGet:
+				s.handleListRepositories(w, r)
+			case name == "" && r.Method == http.MethodPost:
+				s.handleCreateRepository(w, r)
+			case name == "":
+				w.Header().Set("Allow", "GET, POST")
+				http.Error(w,
+					http.StatusText(http.StatusMethodNotAllowed),
+					http.StatusMethodNotAllowed,
+				)
+
+			case r.Method == http.MethodGet:
+				s.handleGetRepository(w, r, name)
+			case r.Method == http.MethodPatch:
+				s.handleUpdateRepository(w, r, name)
+			case r.Method == http.MethodDelete:
+				s.handleDeleteRepository(w, r, name)
+			default:
+				w.Header().Set("Allow", "GET, PATCH, DELETE")
+				http.Error(w,
+					http.StatusText(http.StatusMethodNotAllowed),
+					http.StatusMethodNotAllowed,
+				)
+			}
+		})
+	}
+}
+
+// allows tells whether the client of `r` has `access` to `repo`.
+//
+func (s *HTTPServer) allows(r *http.Request, repo string, access Access) bool {
+	token := tokenFrom(r.Context())
+
+	return s.Authorizer.Allows(identityFrom(r.Context()), repo, access) &&
+		(token == nil || token.Allows(repo, access))
+}
+
+// handleListRepositories lists, by name, the repositories that the client
+// can read from.
+//
+func (s *HTTPServer) handleListRepositories(w http.ResponseWriter, r *http.Request) {
+	names, err := listRepositories(s.DataDirectory)
+	if err != nil {
+		s.apiError(w, r, err)
+		return
+	}
+
+	sort.Strings(names)
+
+	repositories := []RepositoryInfo{}
+	for _, name := range names {
+		if !s.allows(r, name, AccessRead) {
+			continue
+		}
+
+		repo, err := resolveRepository(s.DataDirectory, name)
+		if err != nil {
+			continue
+		}
+
+		info, err := s.repositoryInfo(repo, false)
+		if err != nil {
+			s.apiError(w, r, err)
+			return
+		}
+
+		repositories = append(repositories, *info)
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Repositories []RepositoryInfo `json:"repositories"`
+	}{repositories})
+}
+
+// handleCreateRepository creates an empty repository (with the hooks
+// installed), optionally with a description and default branch.
+//
+func (s *HTTPServer) handleCreateRepository(w http.ResponseWriter, r *http.Request) {
+	var req repositoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("decode body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == nil {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	repo, ok := s.resolveAPIRepository(w, r, *req.Name, AccessWrite)
+	if !ok {
+		return
+	}
+
+	if s.Mirrors.IsMirror(repo.Name) {
+		http.Error(w,
+			fmt.Sprintf("'%s' is a mirror", repo.Name),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	if _, err := os.Stat(repo.Directory); err == nil {
+		http.Error(w,
+			fmt.Sprintf("%s: '%s'", errRepositoryExists, repo.Name),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	if err := initDirAsBareRepository(repo.Directory, s.Backend); err != nil {
+		s.apiError(w, r, err)
+		return
+	}
+
+	if err := s.Hooks.Install(repo.Directory); err != nil {
+		s.apiError(w, r, fmt.Errorf("install hooks: %w", err))
+		return
+	}
+
+	if !s.applyRepositoryRequest(w, r, repo, req) {
+		return
+	}
+
+	log.From(r.Context()).WithFields(log.Fields{
+		"identity":   identityFrom(r.Context()),
+		"repository": repo.Name,
+	}).Info("created repository")
+
+	s.writeRepositoryInfo(w, r, repo, http.StatusCreated)
+}
+
+// handleGetRepository describes a repository, including its refs.
+//
+func (s *HTTPServer) handleGetRepository(w http.ResponseWriter, r *http.Request, name string) {
+	repo, ok := s.resolveExistingAPIRepository(w, r, name, AccessRead)
+	if !ok {
+		return
+	}
+
+	s.writeRepositoryInfo(w, r, repo, http.StatusOK)
+}
+
+// handleUpdateRepository renames a repository and/or updates its
+// description and default branch.
+//
+func (s *HTTPServer) handleUpdateRepository(w http.ResponseWriter, r *http.Request, name string) {
+	repo, ok := s.resolveExistingAPIRepository(w, r, name, AccessWrite)
+	if !ok {
+		return
+	}
+
+	var req repositoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("decode body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != nil {
+		target, ok := s.resolveAPIRepository(w, r, *req.Name, AccessWrite)
+		if !ok {
+			return
+		}
+
+		if target.Name != repo.Name {
+			if !s.renameRepository(w, r, repo, target) {
+				return
+			}
+
+			repo = target
+		}
+	}
+
+	if !s.applyRepositoryRequest(w, r, repo, req) {
+		return
+	}
+
+	s.writeRepositoryInfo(w, r, repo, http.StatusOK)
+}
+
+// handleDeleteRepository removes a repository for good.
+//
+func (s *HTTPServer) handleDeleteRepository(w http.ResponseWriter, r *http.Request, name string) {
+	repo, ok := s.resolveExistingAPIRepository(w, r, name, AccessWrite)
+	if !ok {
+		return
+	}
+
+	if s.Mirrors.IsMirror(repo.Name) {
+		http.Error(w,
+			fmt.Sprintf("'%s' is a mirror (remove it from the mirrors config instead)", repo.Name),
+			http.StatusConflict,
+		)
+		return
+	}
+
+	if !s.checkNotBusy(w, repo) || !s.checkNoNestedRepositories(w, r, repo) {
+		return
+	}
+
+	s.sizes.forget(repo.Directory)
+
+	if err := os.RemoveAll(repo.Directory); err != nil {
+		s.apiError(w, r, fmt.Errorf("remove all '%s': %w", repo.Directory, err))
+		return
+	}
+
+	log.From(r.Context()).WithFields(log.Fields{
+		"identity":   identityFrom(r.Context()),
+		"repository": repo.Name,
+	}).Info("deleted repository")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// renameRepository moves the repository `from` to `to`, which can't be
+// nested in one another.
+//
+func (s *HTTPServer) renameRepository(w http.ResponseWriter, r *http.Request, from, to *repository) bool {
+	if s.Mirrors.IsMirror(from.Name) || s.Mirrors.IsMirror(to.Name) {
+		http.Error(w, "mirrors can't be renamed", http.StatusConflict)
+		return false
+	}
+
+	if isWithinDirectory(to.Directory, from.Directory) ||
+		isWithinDirectory(from.Directory, to.Directory) {
+		http.Error(w,
+			fmt.Sprintf("can't rename '%s' to '%s': one is within the other",
+				from.Name, to.Name),
+			http.StatusConflict,
+		)
+		return false
+	}
+
+	if !s.checkNotBusy(w, from) || !s.checkNoNestedRepositories(w, r, from) {
+		return false
+	}
+
+	if _, err := os.Stat(to.Directory); err == nil {
+		http.Error(w,
+			fmt.Sprintf("%s: '%s'", errRepositoryExists, to.Name),
+			http.StatusConflict,
+		)
+		return false
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to.Directory), 0755); err != nil {
+		s.apiError(w, r, fmt.Errorf("mkdir '%s': %w", filepath.Dir(to.Directory), err))
+		return false
+	}
+
+	s.sizes.forget(from.Directory)
+
+	if err := os.Rename(from.Directory, to.Directory); err != nil {
+		s.apiError(w, r, fmt.Errorf("rename '%s': %w", from.Directory, err))
+		return false
+	}
+
+	log.From(r.Context()).WithFields(log.Fields{
+		"identity":   identityFrom(r.Context()),
+		"repository": to.Name,
+		"from":       from.Name,
+	}).Info("renamed repository")
+
+	return true
+}
+
+// checkNotBusy makes sure that there are no git operations in progress
+// against `repo`, which is then safe to rename or delete.
+//
+// That's only checked once, though: an operation starting right after
+// still races with the rename or removal (failing, or recreating the
+// repository if -auto-create allows it).
+//
+func (s *HTTPServer) checkNotBusy(w http.ResponseWriter, repo *repository) bool {
+	if repositoryBusy(repo.Name) {
+		http.Error(w,
+			fmt.Sprintf("'%s' has git operations in progress", repo.Name),
+			http.StatusConflict,
+		)
+		return false
+	}
+
+	return true
+}
+
+// checkNoNestedRepositories makes sure that no other repositories live
+// under `repo`'s directory (e.g., `foo.git/bar.git`), as they'd be renamed or
+// deleted along with it without any of the checks that they'd get on their
+// own (access, mirrors, operations in progress).
+//
+func (s *HTTPServer) checkNoNestedRepositories(w http.ResponseWriter, r *http.Request, repo *repository) bool {
+	nested, err := nestedRepositories(repo.Directory)
+	if err != nil {
+		s.apiError(w, r, err)
+		return false
+	}
+
+	if len(nested) > 0 {
+		http.Error(w,
+			fmt.Sprintf("'%s' has repositories nested in it: %s",
+				repo.Name, strings.Join(nested, ", ")),
+			http.StatusConflict,
+		)
+		return false
+	}
+
+	return true
+}
+
+// nestedRepositories lists the repositories under `dir` (other than the
+// one at `dir` itself), relative to it.
+//
+func nestedRepositories(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dir '%s': %w", dir, err)
+	}
+
+	nested := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		names, err := listRepositories(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			nested = append(nested, path.Join(entry.Name(), name))
+		}
+	}
+
+	return nested, nil
+}
+
+// isWithinDirectory tells whether `path` is `dir` or sits under it.
+//
+func isWithinDirectory(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// applyRepositoryRequest updates the description and default branch of a
+// repository as requested.
+//
+func (s *HTTPServer) applyRepositoryRequest(w http.ResponseWriter, r *http.Request, repo *repository, req repositoryRequest) bool {
+	if req.Description != nil {
+		if err := setRepositoryDescription(repo.Directory, *req.Description); err != nil {
+			s.apiError(w, r, err)
+			return false
+		}
+	}
+
+	if req.DefaultBranch != nil {
+		if err := setDefaultBranch(repo.Directory, *req.DefaultBranch); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+	}
+
+	return true
+}
+
+// resolveAPIRepository resolves the repository named `name`, making sure
+// that the client has `access` to it.
+//
+func (s *HTTPServer) resolveAPIRepository(w http.ResponseWriter, r *http.Request, name string, access Access) (*repository, bool) {
+	repo, err := resolveRepository(s.DataDirectory, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if !s.allows(r, repo.Name, access) {
+		recordAuthAttempt(transportHTTP, authOutcomeDenied)
+		http.Error(w,
+			fmt.Sprintf("%s: %s", errAccessDenied, repo.Name),
+			http.StatusForbidden,
+		)
+		return nil, false
+	}
+
+	return repo, true
+}
+
+// resolveExistingAPIRepository is resolveAPIRepository for repositories
+// that must exist already.
+//
+func (s *HTTPServer) resolveExistingAPIRepository(w http.ResponseWriter, r *http.Request, name string, access Access) (*repository, bool) {
+	repo, ok := s.resolveAPIRepository(w, r, name, access)
+	if !ok {
+		return nil, false
+	}
+
+	isBare, err := isBareRepository(repo.Directory)
+	if err != nil {
+		s.apiError(w, r, err)
+		return nil, false
+	}
+
+	if !isBare {
+		http.Error(w,
+			fmt.Sprintf("%s: '%s'", errRepositoryNotFound, repo.Name),
+			http.StatusNotFound,
+		)
+		return nil, false
+	}
+
+	return repo, true
+}
+
+func (s *HTTPServer) writeRepositoryInfo(w http.ResponseWriter, r *http.Request, repo *repository, status int) {
+	info, err := s.repositoryInfo(repo, true)
+	if err != nil {
+		s.apiError(w, r, err)
+		return
+	}
+
+	writeJSON(w, status, info)
+}
+
+// repositoryInfo describes `repo`, including its refs if `withRefs`.
+//
+func (s *HTTPServer) repositoryInfo(repo *repository, withRefs bool) (*RepositoryInfo, error) {
+	info := &RepositoryInfo{
+		Name:          repo.Name,
+		DefaultBranch: strings.TrimPrefix(symbolicHead(repo.Directory), "refs/heads/"),
+		Mirror:        s.Mirrors.IsMirror(repo.Name),
+	}
+
+	var err error
+
+	info.Description, err = repositoryDescription(repo.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("description: %w", err)
+	}
+
+	info.Size, err = s.sizes.get(repo.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("directory size '%s': %w", repo.Directory, err)
+	}
+
+	refs, err := repositoryRefs(repo.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("refs: %w", err)
+	}
+
+	if len(refs) > 0 {
+		lastPushAt, err := lastRefUpdate(repo.Directory)
+		if err != nil {
+			return nil, fmt.Errorf("last ref update: %w", err)
+		}
+
+		info.LastPushAt = &lastPushAt
+	}
+
+	if withRefs {
+		info.Refs = refs
+	}
+
+	return info, nil
+}
+
+// sizeCache keeps the sizes of repositories around for
+// `repositoryStatsTTL` so that listing them doesn't walk every one of them
+// on each request.
+//
+type sizeCache struct {
+	mu      sync.Mutex
+	entries map[string]sizeCacheEntry
+}
+
+type sizeCacheEntry struct {
+	size       int64
+	computedAt time.Time
+}
+
+// get retrieves the size of the repository at `dir`, computing it if it's
+// not known or too old.
+//
+func (c *sizeCache) get(dir string) (int64, error) {
+	c.mu.Lock()
+	entry, found := c.entries[dir]
+	c.mu.Unlock()
+
+	if found && time.Since(entry.computedAt) <= repositoryStatsTTL {
+		return entry.size, nil
+	}
+
+	size, err := directorySize(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]sizeCacheEntry{}
+	}
+
+	c.entries[dir] = sizeCacheEntry{size: size, computedAt: time.Now()}
+	return size, nil
+}
+
+// forget drops what's known about the repository at `dir`.
+//
+func (c *sizeCache) forget(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, dir)
+}
+
+func (s *HTTPServer) apiError(w http.ResponseWriter, r *http.Request, err error) {
+	log.From(r.Context()).WithError(err).
+		WithField("url", r.URL.String()).
+		Error("api")
+
+	http.Error(w,
+		http.StatusText(http.StatusInternalServerError),
+		http.StatusInternalServerError,
+	)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
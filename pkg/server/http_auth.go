@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+// authzMiddleware authenticates requests either through a client
+// certificate, a token (bearer, or as the password of basic auth), or a
+// username and password pair, propagating the resulting identity in the
+// request's context.
+//
+func (s *HTTPServer) authzMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, token, ok := s.authenticate(r)
+		if !ok {
+			recordAuthAttempt(transportHTTP, authOutcomeUnauthenticated)
+
+			w.Header().Set(
+				"WWW-Authenticate",
+				`Basic realm="Please enter your username and password."`,
+			)
+
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+			w.Header().Set("Content-Type", "text/plain")
+
+			return
+		}
+
+		recordAuthAttempt(transportHTTP, authOutcomeAuthenticated)
+
+		ctx := withIdentity(r.Context(), identity)
+		if token != nil {
+			ctx = withToken(ctx, token)
+		}
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// authenticate determines the identity of the client, if any, from the
+// credentials that it presented: a verified client certificate,
+// `Authorization: Bearer <token>`, or basic auth with either a token or a
+// password.
+//
+func (s *HTTPServer) authenticate(r *http.Request) (Identity, *Token, bool) {
+	if identity, ok := clientCertificateIdentity(r); ok {
+		return identity, nil, true
+	}
+
+	if secret, ok := bearerToken(r); ok {
+		token := s.lookupToken(secret)
+		if token == nil {
+			return Identity{}, nil, false
+		}
+
+		return Identity{Name: token.Name}, token, true
+	}
+
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return Identity{}, nil, false
+	}
+
+	if token := s.lookupToken(password); token != nil {
+		return Identity{Name: token.Name}, token, true
+	}
+
+	if !s.isAuthenticated(username, password) {
+		return Identity{}, nil, false
+	}
+
+	return Identity{Name: username}, nil, true
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	const prefix = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", false
+	}
+
+	return strings.TrimSpace(auth[len(prefix):]), true
+}
+
+// isAuthenticated verifies the credentials presented by a client against
+// the credentials file, if one was provided, or the single username and
+// password pair otherwise.
+//
+func (s *HTTPServer) isAuthenticated(username, password string) bool {
+	if s.CredentialsFilepath == "" {
+		usernameMatches := subtle.ConstantTimeCompare(
+			[]byte(username), []byte(s.Username),
+		) == 1
+		passwordMatches := subtle.ConstantTimeCompare(
+			[]byte(password), []byte(s.Password),
+		) == 1
+
+		return usernameMatches && passwordMatches
+	}
+
+	expected, found := s.loadCredentials()[username]
+	if !found {
+		return false
+	}
+
+	return expected.Verify(password)
+}
+
+// setCredentials parses the contents of a credentials file and atomically
+// swaps the set of users that can authenticate by the new one.
+//
+func (s *HTTPServer) setCredentials(content []byte) error {
+	creds, err := parseCredentials(content)
+	if err != nil {
+		return fmt.Errorf("parse credentials: %w", err)
+	}
+
+	before := s.loadCredentials().usernames()
+	s.credentials.Store(creds)
+
+	added, removed := diffNames(before, creds.usernames())
+	s.logger.WithFields(log.Fields{
+		"users":   len(creds),
+		"added":   added,
+		"removed": removed,
+	}).Info("loaded credentials")
+
+	return nil
+}
+
+func (s *HTTPServer) loadCredentials() credentials {
+	creds, _ := s.credentials.Load().(credentials)
+	return creds
+}
+
+// setTokens parses the contents of a tokens file and atomically swaps the
+// set of tokens that can be authenticated with by the new one.
+//
+func (s *HTTPServer) setTokens(content []byte) error {
+	tokens, err := ParseTokens(content)
+	if err != nil {
+		return fmt.Errorf("parse tokens: %w", err)
+	}
+
+	var before []string
+	if previous := s.loadTokens(); previous != nil {
+		before = previous.names()
+	}
+
+	s.tokens.Store(tokens)
+
+	after := tokens.names()
+	sort.Strings(before)
+	sort.Strings(after)
+
+	added, removed := diffNames(before, after)
+	s.logger.WithFields(log.Fields{
+		"tokens":  len(tokens.Tokens),
+		"added":   added,
+		"removed": removed,
+	}).Info("loaded tokens")
+
+	return nil
+}
+
+func (s *HTTPServer) loadTokens() *Tokens {
+	tokens, _ := s.tokens.Load().(*Tokens)
+	return tokens
+}
+
+func (s *HTTPServer) lookupToken(secret string) *Token {
+	tokens := s.loadTokens()
+	if tokens == nil || secret == "" {
+		return nil
+	}
+
+	return tokens.Lookup(secret, time.Now())
+}
+
+type tokenCtxKey struct{}
+
+func withToken(ctx context.Context, token *Token) context.Context {
+	return context.WithValue(ctx, tokenCtxKey{}, token)
+}
+
+func tokenFrom(ctx context.Context) *Token {
+	token, _ := ctx.Value(tokenCtxKey{}).(*Token)
+	return token
+}
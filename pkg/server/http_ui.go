@@ -0,0 +1,677 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/russross/blackfriday/v2"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+// uiPathPrefix is the path under which the web ui is served, out of the
+// way of the repositories' own routes.
+//
+const uiPathPrefix = adminPathPrefix + "ui/"
+
+const (
+	// uiLogPageSize is how many commits are shown per page of the log.
+	//
+	uiLogPageSize = 50
+
+	// uiMaxBlobSize is the size of the largest file that gets shown
+	// (and highlighted).
+	//
+	uiMaxBlobSize = 1 << 20
+)
+
+//go:embed ui/*.html
+var uiFS embed.FS
+
+var uiTemplates = template.Must(
+	template.New("ui").Funcs(template.FuncMap{
+		"uiURL":      uiURL,
+		"formatTime": formatTime,
+		"formatSize": formatSize,
+	}).ParseFS(uiFS, "ui/*.html"),
+)
+
+// uiPage is what the templates of the web ui are rendered with, each page
+// making use of only some of the fields.
+//
+type uiPage struct {
+	Page         string
+	Repository   *RepositoryInfo
+	Repositories []RepositoryInfo
+	CloneURL     string
+
+	Revision    string
+	Breadcrumbs []uiBreadcrumb
+	Commit      *uiCommit
+	Entries     []uiEntry
+	Readme      *uiReadme
+	Blob        *uiBlob
+
+	Commits  []uiCommit
+	NextPage int
+
+	Branches []uiRef
+	Tags     []uiRef
+}
+
+type uiBreadcrumb struct {
+	Name string
+	Path string
+}
+
+type uiCommit struct {
+	Hash      string
+	ShortHash string
+	Message   string
+	Author    string
+	When      time.Time
+}
+
+type uiEntry struct {
+	Name string
+	Path string
+	Dir  bool
+	Size int64
+}
+
+type uiReadme struct {
+	Name string
+	HTML template.HTML
+}
+
+type uiBlob struct {
+	Name     string
+	Size     int64
+	Binary   bool
+	TooLarge bool
+	HTML     template.HTML
+}
+
+type uiRef struct {
+	Repository string
+	Name       string
+	Commit     uiCommit
+}
+
+// handleUI serves the read-only web ui: the list of repositories at its
+// root, and the pages of each repository under
+// `<name>.git[/(tree|blob|log)/<revision>[/<path>]|/refs]`.
+//
+func (s *HTTPServer) handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w,
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	// nothing that gets rendered (e.g., READMEs) is allowed to run
+	// scripts.
+	//
+	w.Header().Set("Content-Security-Policy",
+		"default-src 'none'; style-src 'unsafe-inline'; img-src * data:",
+	)
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, uiPathPrefix), "/")
+	if rest == "" {
+		s.handleUIRepositories(w, r)
+		return
+	}
+
+	segments := strings.Split(rest, "/")
+	for idx, segment := range segments {
+		if !strings.HasSuffix(segment, ".git") {
+			continue
+		}
+
+		name := strings.Join(segments[:idx+1], "/")
+		view, args := "", []string{}
+		if idx+1 < len(segments) {
+			view, args = segments[idx+1], segments[idx+2:]
+		}
+
+		s.handleUIRepository(w, r, name, view, args)
+		return
+	}
+
+	http.NotFound(w, r)
+}
+
+func (s *HTTPServer) handleUIRepositories(w http.ResponseWriter, r *http.Request) {
+	names, err := listRepositories(s.DataDirectory)
+	if err != nil {
+		s.uiError(w, r, err)
+		return
+	}
+
+	sort.Strings(names)
+
+	page := &uiPage{Page: "repositories"}
+	for _, name := range names {
+		if !s.allows(r, name, AccessRead) {
+			continue
+		}
+
+		repo, err := resolveRepository(s.DataDirectory, name)
+		if err != nil {
+			continue
+		}
+
+		info, err := s.repositoryInfo(repo, false)
+		if err != nil {
+			s.uiError(w, r, err)
+			return
+		}
+
+		page.Repositories = append(page.Repositories, *info)
+	}
+
+	s.renderUI(w, r, page)
+}
+
+func (s *HTTPServer) handleUIRepository(w http.ResponseWriter, r *http.Request, name, view string, args []string) {
+	repo, ok := s.resolveExistingAPIRepository(w, r, name, AccessRead)
+	if !ok {
+		return
+	}
+
+	info, err := s.repositoryInfo(repo, false)
+	if err != nil {
+		s.uiError(w, r, err)
+		return
+	}
+
+	gitRepo, err := gogit.PlainOpen(repo.Directory)
+	if err != nil {
+		s.uiError(w, r, fmt.Errorf("plain open '%s': %w", repo.Directory, err))
+		return
+	}
+
+	page := &uiPage{Page: view, Repository: info}
+
+	if view == "refs" {
+		page.Revision = uiDefaultRevision(gitRepo)
+		if err := s.uiRefs(gitRepo, page); err != nil {
+			s.uiError(w, r, err)
+			return
+		}
+
+		s.renderUI(w, r, page)
+		return
+	}
+
+	if view == "" {
+		page.Page = "tree"
+	}
+
+	if page.Page != "tree" && page.Page != "blob" && page.Page != "log" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(args) == 0 {
+		args = []string{uiDefaultRevision(gitRepo)}
+	}
+
+	revision, commit, filepath, err := resolveUIRevision(gitRepo, args)
+	if err != nil {
+		if info.LastPushAt == nil && view == "" {
+			page.Page = "empty"
+			page.CloneURL = s.cloneURL(r, repo.Name)
+
+			s.renderUI(w, r, page)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	page.Revision = revision
+	page.Breadcrumbs = uiBreadcrumbs(filepath)
+
+	switch page.Page {
+	case "tree":
+		err = s.uiTree(commit, filepath, page)
+	case "blob":
+		err = s.uiBlob(commit, filepath, page)
+	case "log":
+		skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+		err = s.uiLog(gitRepo, commit, skip, page)
+	}
+
+	if err != nil {
+		if errors.Is(err, object.ErrDirectoryNotFound) ||
+			errors.Is(err, object.ErrFileNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+
+		s.uiError(w, r, err)
+		return
+	}
+
+	s.renderUI(w, r, page)
+}
+
+// uiDefaultRevision is the revision that a repository's page shows: what
+// HEAD points at, or any branch if that doesn't exist (e.g., pushes having
+// only created `main` while HEAD points at `master`).
+//
+func uiDefaultRevision(repo *gogit.Repository) string {
+	head, err := repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return "HEAD"
+	}
+
+	if _, err := repo.Reference(plumbing.HEAD, true); err == nil {
+		if head.Type() == plumbing.SymbolicReference {
+			return head.Target().Short()
+		}
+
+		return "HEAD"
+	}
+
+	branches, err := repo.Branches()
+	if err != nil {
+		return "HEAD"
+	}
+	defer branches.Close()
+
+	branch, err := branches.Next()
+	if err != nil {
+		return "HEAD"
+	}
+
+	return branch.Name().Short()
+}
+
+// resolveUIRevision splits `args` into a revision and the path of a file
+// within it, taking the shortest prefix of them that resolves to a commit
+// as the revision, given that branches can have `/` in their names.
+//
+func resolveUIRevision(repo *gogit.Repository, args []string) (string, *object.Commit, string, error) {
+	for idx := 1; idx <= len(args); idx++ {
+		revision := strings.Join(args[:idx], "/")
+
+		hash, err := repo.ResolveRevision(plumbing.Revision(revision))
+		if err != nil {
+			continue
+		}
+
+		commit, err := repo.CommitObject(*hash)
+		if err != nil {
+			continue
+		}
+
+		return revision, commit, strings.Join(args[idx:], "/"), nil
+	}
+
+	return "", nil, "", fmt.Errorf("revision not found: '%s'", strings.Join(args, "/"))
+}
+
+func (s *HTTPServer) uiTree(commit *object.Commit, dir string, page *uiPage) error {
+	tree, err := commit.Tree()
+	if err != nil {
+		return fmt.Errorf("tree: %w", err)
+	}
+
+	if dir != "" {
+		tree, err = tree.Tree(dir)
+		if err != nil {
+			return fmt.Errorf("tree '%s': %w", dir, err)
+		}
+	}
+
+	c := newUICommit(commit)
+	page.Commit = &c
+
+	for _, entry := range tree.Entries {
+		e := uiEntry{
+			Name: entry.Name,
+			Path: path.Join(dir, entry.Name),
+			Dir:  entry.Mode == filemode.Dir,
+		}
+
+		if entry.Mode.IsFile() {
+			file, err := tree.TreeEntryFile(&entry)
+			if err != nil {
+				return fmt.Errorf("tree entry file '%s': %w", e.Path, err)
+			}
+
+			e.Size = file.Size
+
+			if page.Readme == nil && isReadme(entry.Name) && file.Size <= uiMaxBlobSize {
+				contents, err := file.Contents()
+				if err != nil {
+					return fmt.Errorf("contents '%s': %w", e.Path, err)
+				}
+
+				page.Readme = &uiReadme{
+					Name: entry.Name,
+					HTML: renderReadme(entry.Name, contents),
+				}
+			}
+		}
+
+		page.Entries = append(page.Entries, e)
+	}
+
+	sort.SliceStable(page.Entries, func(i, j int) bool {
+		return page.Entries[i].Dir && !page.Entries[j].Dir
+	})
+
+	return nil
+}
+
+func (s *HTTPServer) uiBlob(commit *object.Commit, filepath string, page *uiPage) error {
+	file, err := commit.File(filepath)
+	if err != nil {
+		return fmt.Errorf("file '%s': %w", filepath, err)
+	}
+
+	blob := &uiBlob{
+		Name: path.Base(filepath),
+		Size: file.Size,
+	}
+	page.Blob = blob
+
+	if file.Size > uiMaxBlobSize {
+		blob.TooLarge = true
+		return nil
+	}
+
+	blob.Binary, err = file.IsBinary()
+	if err != nil {
+		return fmt.Errorf("is binary '%s': %w", filepath, err)
+	}
+
+	if blob.Binary {
+		return nil
+	}
+
+	contents, err := file.Contents()
+	if err != nil {
+		return fmt.Errorf("contents '%s': %w", filepath, err)
+	}
+
+	blob.HTML, err = highlight(blob.Name, contents)
+	if err != nil {
+		return fmt.Errorf("highlight '%s': %w", filepath, err)
+	}
+
+	return nil
+}
+
+func (s *HTTPServer) uiLog(repo *gogit.Repository, commit *object.Commit, skip int, page *uiPage) error {
+	iter, err := repo.Log(&gogit.LogOptions{From: commit.Hash})
+	if err != nil {
+		return fmt.Errorf("log: %w", err)
+	}
+	defer iter.Close()
+
+	for idx := 0; ; idx++ {
+		c, err := iter.Next()
+		if err != nil {
+			break
+		}
+
+		if idx < skip {
+			continue
+		}
+
+		if len(page.Commits) == uiLogPageSize {
+			page.NextPage = skip + uiLogPageSize
+			break
+		}
+
+		page.Commits = append(page.Commits, newUICommit(c))
+	}
+
+	return nil
+}
+
+// uiRefs gathers the branches and tags (newest first) of a repository,
+// along with the commits that they point at.
+//
+func (s *HTTPServer) uiRefs(repo *gogit.Repository, page *uiPage) error {
+	branches, err := repo.Branches()
+	if err != nil {
+		return fmt.Errorf("branches: %w", err)
+	}
+
+	err = branches.ForEach(func(ref *plumbing.Reference) error {
+		commit, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			return nil
+		}
+
+		page.Branches = append(page.Branches, uiRef{
+			Repository: page.Repository.Name,
+			Name:       ref.Name().Short(),
+			Commit:     newUICommit(commit),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("for each branch: %w", err)
+	}
+
+	tags, err := repo.Tags()
+	if err != nil {
+		return fmt.Errorf("tags: %w", err)
+	}
+
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		commit, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			tag, err := repo.TagObject(ref.Hash())
+			if err != nil {
+				return nil
+			}
+
+			commit, err = tag.Commit()
+			if err != nil {
+				return nil
+			}
+		}
+
+		page.Tags = append(page.Tags, uiRef{
+			Repository: page.Repository.Name,
+			Name:       ref.Name().Short(),
+			Commit:     newUICommit(commit),
+		})
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("for each tag: %w", err)
+	}
+
+	sort.Slice(page.Tags, func(i, j int) bool {
+		return page.Tags[i].Commit.When.After(page.Tags[j].Commit.When)
+	})
+
+	return nil
+}
+
+func (s *HTTPServer) renderUI(w http.ResponseWriter, r *http.Request, page *uiPage) {
+	var buf bytes.Buffer
+	if err := uiTemplates.ExecuteTemplate(&buf, page.Page, page); err != nil {
+		s.uiError(w, r, fmt.Errorf("execute template '%s': %w", page.Page, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (s *HTTPServer) uiError(w http.ResponseWriter, r *http.Request, err error) {
+	log.From(r.Context()).WithError(err).
+		WithField("url", r.URL.String()).
+		Error("ui")
+
+	http.Error(w,
+		http.StatusText(http.StatusInternalServerError),
+		http.StatusInternalServerError,
+	)
+}
+
+// cloneURL is the url that `repo` can be cloned from over http, as seen by
+// the client of `r`.
+//
+func (s *HTTPServer) cloneURL(r *http.Request, repo string) string {
+	scheme := "http"
+	if s.tlsEnabled() {
+		scheme = "https"
+	}
+
+	return (&url.URL{Scheme: scheme, Host: r.Host, Path: "/" + repo}).String()
+}
+
+func newUICommit(commit *object.Commit) uiCommit {
+	hash := commit.Hash.String()
+
+	return uiCommit{
+		Hash:      hash,
+		ShortHash: hash[:7],
+		Message:   strings.SplitN(strings.TrimSpace(commit.Message), "\n", 2)[0],
+		Author:    commit.Author.Name,
+		When:      commit.Author.When,
+	}
+}
+
+func uiBreadcrumbs(filepath string) []uiBreadcrumb {
+	breadcrumbs := []uiBreadcrumb{}
+	if filepath == "" {
+		return breadcrumbs
+	}
+
+	segments := strings.Split(filepath, "/")
+	for idx, segment := range segments {
+		breadcrumbs = append(breadcrumbs, uiBreadcrumb{
+			Name: segment,
+			Path: strings.Join(segments[:idx+1], "/"),
+		})
+	}
+
+	return breadcrumbs
+}
+
+func isReadme(name string) bool {
+	switch strings.ToLower(name) {
+	case "readme", "readme.md", "readme.markdown", "readme.txt":
+		return true
+	}
+
+	return false
+}
+
+// renderReadme renders markdown READMEs as html (leaving out any html that
+// they embed), and shows any other as plain text.
+//
+func renderReadme(name, contents string) template.HTML {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".md", ".markdown":
+		renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+			Flags: blackfriday.CommonHTMLFlags |
+				blackfriday.SkipHTML |
+				blackfriday.Safelink,
+		})
+
+		return template.HTML(blackfriday.Run([]byte(contents),
+			blackfriday.WithRenderer(renderer),
+		))
+	}
+
+	return template.HTML("<pre>" + template.HTMLEscapeString(contents) + "</pre>")
+}
+
+// highlight renders `contents` as html with syntax highlighting, picking
+// the language by the file's name or, failing that, its contents.
+//
+func highlight(name, contents string) (template.HTML, error) {
+	lexer := lexers.Match(name)
+	if lexer == nil {
+		lexer = lexers.Analyse(contents)
+	}
+
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, contents)
+	if err != nil {
+		return "", fmt.Errorf("tokenise: %w", err)
+	}
+
+	var buf bytes.Buffer
+	err = chromahtml.New(chromahtml.WithLineNumbers(true)).
+		Format(&buf, styles.Get("github"), iterator)
+	if err != nil {
+		return "", fmt.Errorf("format: %w", err)
+	}
+
+	return template.HTML(buf.String()), nil
+}
+
+// uiURL is the path of a page of the ui, with `elems` (which may contain
+// `/`) escaped segment by segment.
+//
+func uiURL(elems ...string) string {
+	segments := []string{}
+	for _, elem := range elems {
+		for _, segment := range strings.Split(elem, "/") {
+			if segment != "" {
+				segments = append(segments, url.PathEscape(segment))
+			}
+		}
+	}
+
+	return uiPathPrefix + strings.Join(segments, "/")
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04 UTC")
+}
+
+func formatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+)
+
+// Identity identifies who's behind a request, as established by the
+// authentication mechanism of the transport it came through.
+//
+type Identity struct {
+	// Name is the username, token name, or client certificate common name
+	// (HTTP), or the name attached to the authorized key (SSH) - empty for
+	// anonymous requests.
+	//
+	Name string
+
+	// Fingerprint is the SHA256 fingerprint of the public key that an SSH
+	// client authenticated with, or of the certificate that an HTTP client
+	// presented.
+	//
+	Fingerprint string
+}
+
+// IsAnonymous tells whether the identity corresponds to a client that
+// didn't authenticate at all (i.e., `-*-no-auth`).
+//
+func (i Identity) IsAnonymous() bool {
+	return i.Name == "" && i.Fingerprint == ""
+}
+
+func (i Identity) String() string {
+	switch {
+	case i.IsAnonymous():
+		return "anonymous"
+	case i.Name == "":
+		return i.Fingerprint
+	}
+
+	return i.Name
+}
+
+type identityCtxKey struct{}
+
+func withIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityCtxKey{}, identity)
+}
+
+func identityFrom(ctx context.Context) Identity {
+	identity, _ := ctx.Value(identityCtxKey{}).(Identity)
+	return identity
+}
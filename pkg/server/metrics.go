@@ -0,0 +1,453 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+const (
+	MetricsDefaultBindAddr = ":9090"
+
+	metricsNamespace = "git_serve"
+
+	// repositoryStatsTTL is for how long the repository count and sizes
+	// (expensive to compute, as it requires walking the data directory)
+	// are reused across scrapes.
+	//
+	repositoryStatsTTL = time.Minute
+
+	// metricsShutdownTimeout is how long scrapes in progress get to finish
+	// once the server is asked to stop.
+	//
+	metricsShutdownTimeout = 5 * time.Second
+)
+
+const (
+	mirrorSyncSucceeded = "succeeded"
+	mirrorSyncFailed    = "failed"
+
+	pushMirrorPushSucceeded = "succeeded"
+	pushMirrorPushFailed    = "failed"
+)
+
+const (
+	authOutcomeAuthenticated   = "authenticated"
+	authOutcomeUnauthenticated = "unauthenticated"
+	authOutcomeDenied          = "denied"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	authAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_attempts_total",
+		Help: "Authentication and authorization attempts by outcome " +
+			"(authenticated, unauthenticated, or denied): one per " +
+			"request for http, and per connection (however many keys " +
+			"were tried) or denied session for ssh.",
+	}, []string{"transport", "outcome"})
+
+	operations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operations_total",
+		Help: "Git operations (http requests and ssh sessions) by " +
+			"status (http status code, or exit code of git for ssh).",
+	}, []string{"transport", "service", "repository", "code"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of git operations.",
+		Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"transport", "service"})
+
+	transferredBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "transferred_bytes_total",
+		Help: "Bytes received from (in) and sent to (out) clients " +
+			"during git operations.",
+	}, []string{"transport", "service", "repository", "direction"})
+
+	activeOperations = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_operations",
+		Help:      "Git operations in progress.",
+	}, []string{"transport", "service"})
+
+	mirrorSyncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_syncs_total",
+		Help:      "Syncs of mirrors with their upstreams by outcome (succeeded or failed).",
+	}, []string{"repository", "outcome"})
+
+	mirrorLastSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_last_sync_timestamp_seconds",
+		Help:      "When mirrors were last successfully synced with their upstreams.",
+	}, []string{"repository"})
+
+	pushMirrorPushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "push_mirror_pushes_total",
+		Help:      "Pushes of repositories to their push mirrors by outcome (succeeded or failed).",
+	}, []string{"repository", "outcome"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		authAttempts,
+		operations,
+		operationDuration,
+		transferredBytes,
+		activeOperations,
+		mirrorSyncs,
+		mirrorLastSync,
+		pushMirrorPushes,
+	)
+}
+
+// MetricsServer serves the metrics of the git servers in the Prometheus
+// exposition format under `/metrics`.
+//
+type MetricsServer struct {
+	BindAddress   string
+	DataDirectory string
+
+	logger *log.Logger
+}
+
+func (s *MetricsServer) Run(ctx context.Context) error {
+	s.logger = log.From(ctx)
+
+	s.logger.WithFields(log.Fields{
+		"bind-addr": s.BindAddress,
+		"data-dir":  s.DataDirectory,
+	}).Info("starting")
+	defer s.logger.Info("finished")
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&repositoryCollector{
+		root:   s.DataDirectory,
+		logger: s.logger,
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(
+		prometheus.Gatherers{metricsRegistry, registry},
+		promhttp.HandlerOpts{},
+	))
+
+	server := &http.Server{
+		Addr:    s.BindAddress,
+		Handler: mux,
+	}
+
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case <-ctx.Done():
+		// ctx is already done by now, so shutting down happens on a
+		// context of its own.
+		//
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+
+		return server.Shutdown(ctx)
+	case err := <-doneCh:
+		return err
+	}
+}
+
+// operation tracks a single git operation, from start to finish.
+//
+type operation struct {
+	transport  string
+	service    string
+	repository string
+	identity   Identity
+	remoteAddr string
+	start      time.Time
+
+	in  int64
+	out int64
+}
+
+// busyRepositories counts, by repository, the git operations in progress
+// over either transport, so that repositories aren't renamed or deleted
+// from under them.
+//
+var busyRepositories = struct {
+	sync.Mutex
+	operations map[string]int
+}{operations: map[string]int{}}
+
+// repositoryBusy tells whether there are git operations in progress
+// against the repository named `name`.
+//
+func repositoryBusy(name string) bool {
+	busyRepositories.Lock()
+	defer busyRepositories.Unlock()
+
+	return busyRepositories.operations[name] > 0
+}
+
+func startOperation(transport string, service gitService, repo *repository, identity Identity, remoteAddr string) *operation {
+	op := &operation{
+		transport:  transport,
+		service:    service.Subcommand(),
+		repository: repo.Name,
+		identity:   identity,
+		remoteAddr: remoteAddr,
+		start:      time.Now(),
+	}
+
+	busyRepositories.Lock()
+	busyRepositories.operations[op.repository]++
+	busyRepositories.Unlock()
+
+	activeOperations.WithLabelValues(op.transport, op.service).Inc()
+	return op
+}
+
+// reader counts the bytes read from `r` as received from the client.
+//
+func (op *operation) reader(r io.Reader) io.Reader {
+	return &countingReader{r, &op.in}
+}
+
+// writer counts the bytes written to `w` as sent to the client.
+//
+func (op *operation) writer(w io.Writer) io.Writer {
+	return &countingWriter{w, &op.out}
+}
+
+func (op *operation) finish(code int) {
+	busyRepositories.Lock()
+	busyRepositories.operations[op.repository]--
+	if busyRepositories.operations[op.repository] <= 0 {
+		delete(busyRepositories.operations, op.repository)
+	}
+	busyRepositories.Unlock()
+
+	activeOperations.WithLabelValues(op.transport, op.service).Dec()
+
+	operations.WithLabelValues(
+		op.transport, op.service, op.repository, strconv.Itoa(code),
+	).Inc()
+
+	operationDuration.WithLabelValues(op.transport, op.service).
+		Observe(time.Since(op.start).Seconds())
+
+	transferredBytes.WithLabelValues(
+		op.transport, op.service, op.repository, "in",
+	).Add(float64(atomic.LoadInt64(&op.in)))
+
+	transferredBytes.WithLabelValues(
+		op.transport, op.service, op.repository, "out",
+	).Add(float64(atomic.LoadInt64(&op.out)))
+}
+
+func recordAuthAttempt(transport, outcome string) {
+	authAttempts.WithLabelValues(transport, outcome).Inc()
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+// meteredResponseWriter captures the status code and counts the bytes of
+// a response.
+//
+type meteredResponseWriter struct {
+	http.ResponseWriter
+
+	op     *operation
+	status int
+}
+
+func (w *meteredResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *meteredResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.op.out, int64(n))
+	return n, err
+}
+
+func (w *meteredResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+var (
+	repositoriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "repositories"),
+		"Repositories in the data directory.",
+		nil, nil,
+	)
+
+	repositorySizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "repository_size_bytes"),
+		"Disk usage of each repository in the data directory.",
+		[]string{"repository"}, nil,
+	)
+)
+
+// repositoryCollector collects the number of repositories in the data
+// directory and how much space each takes.
+//
+type repositoryCollector struct {
+	root   string
+	logger *log.Logger
+
+	mu          sync.Mutex
+	sizes       map[string]int64
+	collectedAt time.Time
+}
+
+func (c *repositoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- repositoriesDesc
+	ch <- repositorySizeDesc
+}
+
+func (c *repositoryCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.collectedAt) > repositoryStatsTTL {
+		sizes, err := repositorySizes(c.root)
+		if err != nil {
+			c.logger.WithError(err).Error("repository sizes")
+		} else {
+			c.sizes, c.collectedAt = sizes, time.Now()
+		}
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		repositoriesDesc, prometheus.GaugeValue, float64(len(c.sizes)),
+	)
+
+	for name, size := range c.sizes {
+		ch <- prometheus.MustNewConstMetric(
+			repositorySizeDesc, prometheus.GaugeValue, float64(size), name,
+		)
+	}
+}
+
+// repositorySizes walks `root` looking for bare repositories, summing up
+// the sizes of the files in each.
+//
+func repositorySizes(root string) (map[string]int64, error) {
+	sizes := map[string]int64{}
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == root {
+				return filepath.SkipDir
+			}
+
+			return err
+		}
+
+		if !d.IsDir() || !strings.HasSuffix(path, ".git") {
+			return nil
+		}
+
+		isBare, err := isBareRepository(path)
+		if err != nil || !isBare {
+			return err
+		}
+
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return fmt.Errorf("rel '%s': %w", path, err)
+		}
+
+		size, err := directorySize(path)
+		if err != nil {
+			return fmt.Errorf("directory size '%s': %w", path, err)
+		}
+
+		sizes[filepath.ToSlash(name)] = size
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk '%s': %w", root, err)
+	}
+
+	return sizes, nil
+}
+
+func directorySize(dir string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		size += info.Size()
+		return nil
+	})
+
+	return size, err
+}
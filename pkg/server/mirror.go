@@ -0,0 +1,594 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+const (
+	// MirrorDefaultInterval is how often mirrors get synced with their
+	// upstreams when no interval is configured.
+	//
+	MirrorDefaultInterval = 5 * time.Minute
+
+	// mirrorSyncTimeout is how long a single sync (clone or fetch) can
+	// take.
+	//
+	mirrorSyncTimeout = 10 * time.Minute
+)
+
+var errMirrorReadOnly = errors.New("repository is a read-only mirror")
+
+// MirrorsConfig lists the repositories that are kept as read-only mirrors
+// of upstream ones.
+//
+// ```yaml
+// mirrors:
+//   - name: upstream/foo.git
+//     url: https://github.com/org/foo.git
+//     interval: 10m
+//     username: bot
+//     password: s3cr3t
+// ```
+//
+type MirrorsConfig struct {
+	Mirrors []Mirror `json:"mirrors"`
+}
+
+// Mirror is a repository that's cloned from an upstream one, and then
+// periodically synced with it.
+//
+type Mirror struct {
+	// Name is the name of the repository (e.g., `upstream/foo.git`).
+	//
+	Name string `json:"name"`
+
+	// URL is where the upstream repository is cloned from - anything
+	// that `git clone` takes.
+	//
+	URL string `json:"url"`
+
+	// Interval is how often the mirror gets synced (defaults to
+	// MirrorDefaultInterval).
+	//
+	Interval Duration `json:"interval,omitempty"`
+
+	RemoteCredentials `json:",inline"`
+}
+
+func (m Mirror) interval() time.Duration {
+	if m.Interval.Duration == 0 {
+		return MirrorDefaultInterval
+	}
+
+	return m.Interval.Duration
+}
+
+// RemoteCredentials are what git authenticates to remote repositories
+// with.
+//
+type RemoteCredentials struct {
+	// Username and Password, if set, are sent as basic auth credentials
+	// to http(s) remotes.
+	//
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	// SSHKeyFilepath, if set, is the private key to authenticate to ssh
+	// remotes with.
+	//
+	SSHKeyFilepath string `json:"sshKey,omitempty"`
+}
+
+// env is the environment for git to reach remotes with, passing the
+// credentials through it rather than arguments so that they don't show up
+// in the process list.
+//
+func (c RemoteCredentials) env() []string {
+	env := gitEnv("GIT_TERMINAL_PROMPT=0")
+
+	if c.Username != "" || c.Password != "" {
+		credentials := base64.StdEncoding.EncodeToString(
+			[]byte(c.Username + ":" + c.Password),
+		)
+
+		env = append(env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Basic "+credentials,
+		)
+	}
+
+	if c.SSHKeyFilepath != "" {
+		env = append(env, "GIT_SSH_COMMAND=ssh -i "+shellQuote(c.SSHKeyFilepath)+
+			" -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new",
+		)
+	}
+
+	return env
+}
+
+// redactURL strips the credentials (if any) out of the url of a remote,
+// so that it can be shown to clients and written to logs.
+//
+func redactURL(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil || u.User == nil {
+		return remote
+	}
+
+	u.User = nil
+	return u.String()
+}
+
+// shellQuote quotes `s` so that a shell takes it as a single word, as is -
+// git runs `GIT_SSH_COMMAND` through one.
+//
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Duration is a time.Duration that's represented in configuration files
+// in the format of time.ParseDuration (e.g., `1m30s`).
+//
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("unmarshal: %w", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("parse duration: %w", err)
+	}
+
+	d.Duration = v
+	return nil
+}
+
+// ParseMirrorsConfig parses the mirrors configuration in either YAML or
+// JSON.
+//
+func ParseMirrorsConfig(content []byte) (*MirrorsConfig, error) {
+	config := &MirrorsConfig{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	seen := map[string]bool{}
+	for idx, mirror := range config.Mirrors {
+		name, err := normalizeRepositoryName(mirror.Name)
+		if err != nil {
+			return nil, fmt.Errorf("mirror %d: %w", idx, err)
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("mirror %d: duplicate name '%s'", idx, name)
+		}
+		seen[name] = true
+
+		if mirror.URL == "" {
+			return nil, fmt.Errorf("mirror %d: url must be set", idx)
+		}
+
+		if mirror.Interval.Duration < 0 {
+			return nil, fmt.Errorf("mirror %d: interval must be positive", idx)
+		}
+
+		config.Mirrors[idx].Name = name
+	}
+
+	return config, nil
+}
+
+// MirrorStatus is how syncing a mirror with its upstream has been going.
+//
+type MirrorStatus struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+
+	// LastSyncAt is when the mirror was last successfully synced.
+	//
+	LastSyncAt *time.Time `json:"lastSyncAt,omitempty"`
+
+	// LastAttemptAt is when a sync was last attempted, successful or not.
+	//
+	LastAttemptAt *time.Time `json:"lastAttemptAt,omitempty"`
+
+	// Error is why the last attempt failed, if it did.
+	//
+	Error string `json:"error,omitempty"`
+
+	// Head is the commit that HEAD pointed at after the last sync.
+	//
+	Head string `json:"head,omitempty"`
+
+	inflight bool
+}
+
+// Mirrors keeps the repositories in a configuration file (reloaded
+// whenever it changes) in sync with their upstreams: cloning them (with
+// `git clone --mirror`) the first time, and fetching from them every
+// interval.
+//
+// Mirrored repositories are read-only: pushes to them are rejected, and
+// they never get auto-created (as they'd then not be mirrors).
+//
+// A nil Mirrors mirrors nothing.
+//
+type Mirrors struct {
+	ConfigFilepath        string
+	DataDirectory         string
+	GitExecutableFilepath string
+
+	logger   *log.Logger
+	config   atomic.Value // *MirrorsConfig
+	watcher  *fileWatcher
+	mu       sync.Mutex
+	statuses map[string]*MirrorStatus
+}
+
+// Load loads the configuration for the first time, failing if it can't be
+// parsed.
+//
+func (m *Mirrors) Load(ctx context.Context) error {
+	m.logger = log.From(ctx)
+	m.statuses = map[string]*MirrorStatus{}
+
+	m.watcher = &fileWatcher{
+		Filepath: m.ConfigFilepath,
+		OnChange: m.setConfig,
+	}
+
+	if err := m.watcher.Load(); err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+
+	return nil
+}
+
+// Run syncs the mirrors as they become due until the context is
+// cancelled, starting with syncing all of them.
+//
+func (m *Mirrors) Run(ctx context.Context) error {
+	go m.watcher.Run(ctx)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		for _, mirror := range m.dueMirrors(time.Now()) {
+			wg.Add(1)
+			go func(mirror Mirror) {
+				defer wg.Done()
+				m.sync(ctx, mirror)
+			}(mirror)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// IsMirror tells whether the repository named `repo` is a mirror.
+//
+func (m *Mirrors) IsMirror(repo string) bool {
+	if m == nil {
+		return false
+	}
+
+	_, found := m.mirror(repo)
+	return found
+}
+
+// Statuses lists, by name, the status of the mirrors that `filter`
+// accepts.
+//
+func (m *Mirrors) Statuses(filter func(repo string) bool) []MirrorStatus {
+	if m == nil {
+		return []MirrorStatus{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := []MirrorStatus{}
+	for _, mirror := range m.loadConfig().Mirrors {
+		if !filter(mirror.Name) {
+			continue
+		}
+
+		status := MirrorStatus{Name: mirror.Name, URL: redactURL(mirror.URL)}
+		if s, found := m.statuses[mirror.Name]; found {
+			status = *s
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
+
+// openPolicy is the auto-create policy to open `repo` with for `service`,
+// failing if the service can't be run against it.
+//
+func (m *Mirrors) openPolicy(repo string, service gitService, policy AutoCreatePolicy) (AutoCreatePolicy, error) {
+	if !m.IsMirror(repo) {
+		return policy, nil
+	}
+
+	if service == serviceReceivePack {
+		return "", fmt.Errorf("%w: %s", errMirrorReadOnly, repo)
+	}
+
+	return AutoCreateNever, nil
+}
+
+// dueMirrors marks as inflight, and returns, the mirrors that either were
+// never synced or whose interval elapsed since they were last attempted.
+//
+func (m *Mirrors) dueMirrors(now time.Time) []Mirror {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	due := []Mirror{}
+	for _, mirror := range m.loadConfig().Mirrors {
+		status, found := m.statuses[mirror.Name]
+		if !found {
+			status = &MirrorStatus{Name: mirror.Name}
+			m.statuses[mirror.Name] = status
+		}
+
+		status.URL = redactURL(mirror.URL)
+
+		if status.inflight {
+			continue
+		}
+
+		if status.LastAttemptAt != nil &&
+			now.Sub(*status.LastAttemptAt) < mirror.interval() {
+			continue
+		}
+
+		status.inflight = true
+		due = append(due, mirror)
+	}
+
+	return due
+}
+
+func (m *Mirrors) sync(ctx context.Context, mirror Mirror) {
+	logger := m.logger.WithFields(log.Fields{
+		"repository": mirror.Name,
+		"url":        redactURL(mirror.URL),
+	})
+
+	started := time.Now()
+	head, err := m.syncRepository(ctx, mirror)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status, found := m.statuses[mirror.Name]
+	if !found {
+		status = &MirrorStatus{Name: mirror.Name, URL: redactURL(mirror.URL)}
+		m.statuses[mirror.Name] = status
+	}
+
+	now := time.Now()
+	status.inflight = false
+	status.LastAttemptAt = &now
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+
+		status.Error = strings.ReplaceAll(err.Error(), mirror.URL, redactURL(mirror.URL))
+		mirrorSyncs.WithLabelValues(mirror.Name, mirrorSyncFailed).Inc()
+		logger.WithError(err).Error("sync")
+		return
+	}
+
+	status.Error = ""
+	status.LastSyncAt = &now
+	status.Head = head
+	mirrorSyncs.WithLabelValues(mirror.Name, mirrorSyncSucceeded).Inc()
+	mirrorLastSync.WithLabelValues(mirror.Name).Set(float64(now.Unix()))
+
+	logger.WithFields(log.Fields{
+		"head":     head,
+		"duration": now.Sub(started),
+	}).Info("synced")
+}
+
+// syncRepository clones the upstream into the data directory if the
+// mirror doesn't exist yet, or fetches from it otherwise, returning what
+// HEAD points at afterwards.
+//
+func (m *Mirrors) syncRepository(ctx context.Context, mirror Mirror) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, mirrorSyncTimeout)
+	defer cancel()
+
+	repo, err := resolveRepository(m.DataDirectory, mirror.Name)
+	if err != nil {
+		return "", fmt.Errorf("resolve: %w", err)
+	}
+
+	isBare, err := isBareRepository(repo.Directory)
+	if err != nil {
+		return "", fmt.Errorf("is bare check: %w", err)
+	}
+
+	if !isBare {
+		if err := cloneMirror(ctx, m.GitExecutableFilepath, repo, mirror); err != nil {
+			return "", fmt.Errorf("clone: %w", err)
+		}
+
+		return resolveHead(m.GitExecutableFilepath, repo.Directory), nil
+	}
+
+	if err := fetchMirror(ctx, m.GitExecutableFilepath, repo, mirror); err != nil {
+		return "", fmt.Errorf("fetch: %w", err)
+	}
+
+	return resolveHead(m.GitExecutableFilepath, repo.Directory), nil
+}
+
+// cloneMirror clones the upstream into a temporary directory next to where
+// the repository should end up, moving it into place once done.
+//
+func cloneMirror(ctx context.Context, git string, repo *repository, mirror Mirror) error {
+	parent := filepath.Dir(repo.Directory)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("mkdir '%s': %w", parent, err)
+	}
+
+	if _, err := os.Stat(repo.Directory); err == nil {
+		return fmt.Errorf("'%s' exists but is not a bare repository",
+			repo.Directory,
+		)
+	}
+
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(repo.Directory)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("mkdir temp: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cmd := exec.CommandContext(ctx, git, "clone", "--quiet", "--mirror",
+		"--config", "core.sharedRepository=group",
+		mirror.URL, tmp,
+	)
+	cmd.Env = mirror.env()
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// the temp dir gets created with 0700.
+	//
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return fmt.Errorf("chmod '%s': %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, repo.Directory); err != nil {
+		return fmt.Errorf("rename '%s': %w", tmp, err)
+	}
+
+	return nil
+}
+
+// fetchMirror fetches every ref from the upstream, pruning those that no
+// longer exist there - (re)configuring the remote first so that changes to
+// the url take effect.
+//
+func fetchMirror(ctx context.Context, git string, repo *repository, mirror Mirror) error {
+	for _, kv := range [][2]string{
+		{"remote.origin.url", mirror.URL},
+		{"remote.origin.fetch", "+refs/*:refs/*"},
+		{"remote.origin.mirror", "true"},
+	} {
+		if out, err := execAt(repo.Directory, git, "config", kv[0], kv[1]); err != nil {
+			return fmt.Errorf("config '%s': %w: %s", kv[0], err, out)
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, git, "fetch", "--quiet", "--prune", "origin")
+	cmd.Dir = repo.Directory
+	cmd.Env = mirror.env()
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	// fetching doesn't update HEAD, so point it at whatever the upstream's
+	// points at.
+	//
+	cmd = exec.CommandContext(ctx, git, "ls-remote", "--symref", "origin", "HEAD")
+	cmd.Dir = repo.Directory
+	cmd.Env = mirror.env()
+
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("ls-remote: %w", err)
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "ref:" || fields[2] != "HEAD" {
+			continue
+		}
+
+		if out, err := execAt(repo.Directory, git, "symbolic-ref", "HEAD", fields[1]); err != nil {
+			return fmt.Errorf("symbolic-ref HEAD '%s': %w: %s", fields[1], err, out)
+		}
+	}
+
+	return nil
+}
+
+func (m *Mirrors) mirror(repo string) (Mirror, bool) {
+	for _, mirror := range m.loadConfig().Mirrors {
+		if mirror.Name == repo {
+			return mirror, true
+		}
+	}
+
+	return Mirror{}, false
+}
+
+func (m *Mirrors) setConfig(content []byte) error {
+	config, err := ParseMirrorsConfig(content)
+	if err != nil {
+		return fmt.Errorf("parse mirrors config: %w", err)
+	}
+
+	m.config.Store(config)
+	m.logger.WithField("mirrors", len(config.Mirrors)).Info("loaded mirrors")
+
+	return nil
+}
+
+func (m *Mirrors) loadConfig() *MirrorsConfig {
+	config, _ := m.config.Load().(*MirrorsConfig)
+	if config == nil {
+		return &MirrorsConfig{}
+	}
+
+	return config
+}
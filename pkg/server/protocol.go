@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	// gitProtocolVariable is the environment variable through which git
+	// learns about the protocol (e.g., `version=2`) that the client asked
+	// for: set by clients over ssh (with `SendEnv`/`SetEnv`), and by the
+	// server from the Git-Protocol header over http.
+	//
+	gitProtocolVariable = "GIT_PROTOCOL"
+
+	// gitProtocolHeader is the http header that clients ask for a
+	// protocol with.
+	//
+	gitProtocolHeader = "Git-Protocol"
+
+	// maxGitProtocolLength is how long the protocol requested by a client
+	// can be before being ignored.
+	//
+	maxGitProtocolLength = 256
+)
+
+// gitProtocolPattern matches what git sends as the protocol: colon-separated
+// `key[=value]` parameters (e.g., `version=2`).
+//
+var gitProtocolPattern = regexp.MustCompile(`^[A-Za-z0-9._=:-]*$`)
+
+// uploadPackConfig is the configuration that git-upload-pack runs with,
+// letting clients make use of the capabilities that come with protocol v2
+// and partial clones.
+//
+var uploadPackConfig = [][2]string{
+	// `--filter` (e.g., `blob:none`) for partial clones.
+	//
+	{"uploadpack.allowFilter", "true"},
+
+	// fetching (reachable) objects by id, as partial clones do for what
+	// they lazily fetch later on - needed with protocol v0 over ssh.
+	//
+	{"uploadpack.allowReachableSHA1InWant", "true"},
+
+	// `want-ref` in protocol v2's `fetch`.
+	//
+	{"uploadpack.allowRefInWant", "true"},
+}
+
+// gitServiceEnv is the environment (on top of hookEnv's) that git services
+// run with: the configuration they need, and the protocol that the client
+// asked for - unless it doesn't look like one that git would ask for, in
+// which case git falls back to protocol v0.
+//
+func gitServiceEnv(protocol string) []string {
+	env := []string{
+		fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(uploadPackConfig)),
+	}
+
+	for idx, kv := range uploadPackConfig {
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", idx, kv[0]),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", idx, kv[1]),
+		)
+	}
+
+	if !isValidGitProtocol(protocol) {
+		protocol = ""
+	}
+
+	return append(env, gitProtocolVariable+"="+protocol)
+}
+
+func isValidGitProtocol(protocol string) bool {
+	return protocol != "" &&
+		len(protocol) <= maxGitProtocolLength &&
+		gitProtocolPattern.MatchString(protocol)
+}
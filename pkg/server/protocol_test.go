@@ -0,0 +1,32 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsValidGitProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		protocol string
+		valid    bool
+	}{
+		{"version=2", true},
+		{"version=1", true},
+		{"version=2:object-format=sha256", true},
+		{"some-key", true},
+		{strings.Repeat("a", maxGitProtocolLength), true},
+
+		{"", false},
+		{"version=2 ", false},
+		{"version=2\nGIT_DIR=/", false},
+		{"version=2;rm -rf /", false},
+		{"$(id)", false},
+		{strings.Repeat("a", maxGitProtocolLength+1), false},
+	} {
+		if valid := isValidGitProtocol(tc.protocol); valid != tc.valid {
+			t.Errorf("isValidGitProtocol(%q): expected %t, got %t",
+				tc.protocol, tc.valid, valid,
+			)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxPushCommits is the maximum number of commits listed in a push event,
+// as with GitHub's.
+//
+const maxPushCommits = 20
+
+// refs maps the name of each ref in a repository to the object it points
+// to.
+//
+type refs map[string]string
+
+// refUpdate is the change that a push made to a ref, with either side
+// being all zeros for refs that got created or deleted.
+//
+type refUpdate struct {
+	Ref    string
+	Before string
+	After  string
+}
+
+func (u refUpdate) created() bool { return isZeroObject(u.Before) }
+func (u refUpdate) deleted() bool { return isZeroObject(u.After) }
+
+// snapshotRefs lists the refs in the repository at `dir`.
+//
+func snapshotRefs(dir string) (refs, error) {
+	snapshot, err := repositoryRefs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return refs(snapshot), nil
+}
+
+// diffRefs computes the updates that took the refs from `before` to
+// `after`, sorted by ref name.
+//
+func diffRefs(before, after refs) []refUpdate {
+	updates := []refUpdate{}
+
+	for ref, newObj := range after {
+		oldObj, found := before[ref]
+		switch {
+		case !found:
+			updates = append(updates, refUpdate{ref, zeroObject(newObj), newObj})
+		case oldObj != newObj:
+			updates = append(updates, refUpdate{ref, oldObj, newObj})
+		}
+	}
+
+	for ref, oldObj := range before {
+		if _, found := after[ref]; !found {
+			updates = append(updates, refUpdate{ref, oldObj, zeroObject(oldObj)})
+		}
+	}
+
+	sort.Slice(updates, func(i, j int) bool {
+		return updates[i].Ref < updates[j].Ref
+	})
+
+	return updates
+}
+
+func zeroObject(like string) string {
+	return strings.Repeat("0", len(like))
+}
+
+func isZeroObject(obj string) bool {
+	return strings.Trim(obj, "0") == ""
+}
+
+// pushEvent is the payload of a push webhook, compatible with GitHub's
+// (https://docs.github.com/en/webhooks/webhook-events-and-payloads#push).
+//
+type pushEvent struct {
+	Ref        string         `json:"ref"`
+	Before     string         `json:"before"`
+	After      string         `json:"after"`
+	Created    bool           `json:"created"`
+	Deleted    bool           `json:"deleted"`
+	Forced     bool           `json:"forced"`
+	Commits    []pushCommit   `json:"commits"`
+	HeadCommit *pushCommit    `json:"head_commit"`
+	Repository pushRepository `json:"repository"`
+	Pusher     pushUser       `json:"pusher"`
+	Sender     pushSender     `json:"sender"`
+	Transport  string         `json:"transport"`
+}
+
+type pushCommit struct {
+	ID        string   `json:"id"`
+	TreeID    string   `json:"tree_id"`
+	Distinct  bool     `json:"distinct"`
+	Message   string   `json:"message"`
+	Timestamp string   `json:"timestamp"`
+	Author    pushUser `json:"author"`
+	Committer pushUser `json:"committer"`
+}
+
+type pushRepository struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+}
+
+type pushUser struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type pushSender struct {
+	Login string `json:"login"`
+}
+
+// newPushEvent builds the event for an update made to a ref of the
+// repository by `identity`, listing the commits that it introduced (those
+// not reachable from any ref as they were before the push) by executing
+// `git`.
+//
+func newPushEvent(git string, repo *repository, identity Identity, transport string, update refUpdate, before refs) (*pushEvent, error) {
+	name := strings.TrimSuffix(repo.Name, ".git")
+
+	event := &pushEvent{
+		Ref:     update.Ref,
+		Before:  update.Before,
+		After:   update.After,
+		Created: update.created(),
+		Deleted: update.deleted(),
+		Commits: []pushCommit{},
+		Repository: pushRepository{
+			Name:     path.Base(name),
+			FullName: name,
+		},
+		Pusher:    pushUser{Name: identity.String()},
+		Sender:    pushSender{Login: identity.String()},
+		Transport: transport,
+	}
+
+	if event.Deleted {
+		return event, nil
+	}
+
+	if !event.Created {
+		forced, err := isForcedUpdate(git, repo.Directory, update)
+		if err != nil {
+			return nil, fmt.Errorf("forced update check: %w", err)
+		}
+
+		event.Forced = forced
+	}
+
+	commits, err := introducedCommits(git, repo.Directory, update.After, before)
+	if err != nil {
+		return nil, fmt.Errorf("introduced commits: %w", err)
+	}
+
+	event.Commits = commits
+
+	head, err := readCommit(git, repo.Directory, update.After)
+	if err != nil {
+		return nil, fmt.Errorf("read commit '%s': %w", update.After, err)
+	}
+
+	event.HeadCommit = head
+	return event, nil
+}
+
+// isForcedUpdate tells whether the update rewrote history, i.e., the old
+// object is not an ancestor of the new one.
+//
+func isForcedUpdate(git, dir string, update refUpdate) (bool, error) {
+	out, err := execAt(dir, git, "merge-base", "--is-ancestor", update.Before, update.After)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+			return true, nil
+		}
+
+		return false, fmt.Errorf("merge-base: %w: %s", err, out)
+	}
+
+	return false, nil
+}
+
+// commitFormat is the `git log` format that parseCommits parses: fields are
+// separated by NUL and commits by the record separator.
+//
+const commitFormat = "%H%x00%T%x00%aI%x00%an%x00%ae%x00%cn%x00%ce%x00%B%x1e"
+
+// introducedCommits lists, oldest first, the (up to maxPushCommits most
+// recent) commits reachable from `obj` but not from any of the refs in
+// `before`.
+//
+func introducedCommits(git, dir, obj string, before refs) ([]pushCommit, error) {
+	stdin := &bytes.Buffer{}
+	fmt.Fprintln(stdin, obj)
+	for _, other := range before {
+		fmt.Fprintln(stdin, "^"+other)
+	}
+
+	cmd := exec.Command(git, "log", "--stdin", "--reverse",
+		fmt.Sprintf("--max-count=%d", maxPushCommits),
+		"--format="+commitFormat,
+	)
+	cmd.Dir = dir
+	cmd.Stdin = stdin
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("log: %w", err)
+	}
+
+	return parseCommits(out), nil
+}
+
+func readCommit(git, dir, obj string) (*pushCommit, error) {
+	out, err := execAt(dir, git, "log", "-1", "--format="+commitFormat, obj)
+	if err != nil {
+		return nil, fmt.Errorf("log: %w: %s", err, out)
+	}
+
+	commits := parseCommits(out)
+	if len(commits) == 0 {
+		return nil, fmt.Errorf("commit not found")
+	}
+
+	return &commits[0], nil
+}
+
+func parseCommits(out []byte) []pushCommit {
+	commits := []pushCommit{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	scanner.Buffer(nil, 1<<20)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if idx := bytes.IndexByte(data, 0x1e); idx >= 0 {
+			return idx + 1, data[:idx], nil
+		}
+
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+
+		return 0, nil, nil
+	})
+
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimLeft(scanner.Text(), "\n"), "\x00", 8)
+		if len(fields) != 8 {
+			continue
+		}
+
+		commits = append(commits, pushCommit{
+			ID:        fields[0],
+			TreeID:    fields[1],
+			Distinct:  true,
+			Timestamp: fields[2],
+			Author:    pushUser{Name: fields[3], Email: fields[4]},
+			Committer: pushUser{Name: fields[5], Email: fields[6]},
+			Message:   strings.TrimRight(fields[7], "\n"),
+		})
+	}
+
+	return commits
+}
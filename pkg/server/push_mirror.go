@@ -0,0 +1,511 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+const (
+	// pushMirrorMaxBackoff caps how long to wait between attempts at
+	// pushing to a push mirror.
+	//
+	pushMirrorMaxBackoff = time.Hour
+
+	// pushMirrorTimeout is how long a single push can take.
+	//
+	pushMirrorTimeout = 10 * time.Minute
+)
+
+// PushMirrorsConfig lists the remotes that repositories get replicated to
+// whenever they're pushed to.
+//
+// ```yaml
+// pushMirrors:
+//   - repository: team/foo.git
+//     url: https://git.example.com/backup/foo.git
+//     username: bot
+//     password: s3cr3t
+// ```
+//
+type PushMirrorsConfig struct {
+	PushMirrors []PushMirror `json:"pushMirrors"`
+}
+
+// PushMirror is a remote that a repository is pushed to (with `git push
+// --mirror`, thus replicating every ref, and pruning those that went away)
+// after each push it receives.
+//
+type PushMirror struct {
+	// Repository is the name of the repository to replicate (e.g.,
+	// `team/foo.git`).
+	//
+	Repository string `json:"repository"`
+
+	// URL is where the repository gets pushed to - anything that `git
+	// push` takes.
+	//
+	URL string `json:"url"`
+
+	RemoteCredentials `json:",inline"`
+}
+
+// ParsePushMirrorsConfig parses the push mirrors configuration in either
+// YAML or JSON.
+//
+func ParsePushMirrorsConfig(content []byte) (*PushMirrorsConfig, error) {
+	config := &PushMirrorsConfig{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	seen := map[pushMirrorKey]bool{}
+	for idx, mirror := range config.PushMirrors {
+		name, err := normalizeRepositoryName(mirror.Repository)
+		if err != nil {
+			return nil, fmt.Errorf("push mirror %d: %w", idx, err)
+		}
+
+		if mirror.URL == "" {
+			return nil, fmt.Errorf("push mirror %d: url must be set", idx)
+		}
+
+		key := pushMirrorKey{name, mirror.URL}
+		if seen[key] {
+			return nil, fmt.Errorf("push mirror %d: duplicate of '%s' to '%s'",
+				idx, name, mirror.URL,
+			)
+		}
+		seen[key] = true
+
+		config.PushMirrors[idx].Repository = name
+	}
+
+	return config, nil
+}
+
+type pushMirrorKey struct {
+	repository string
+	url        string
+}
+
+// PushMirrorStatus is how replicating a repository to a push mirror has
+// been going.
+//
+type PushMirrorStatus struct {
+	Repository string `json:"repository"`
+	URL        string `json:"url"`
+
+	// Pending tells whether there are changes yet to be pushed.
+	//
+	Pending bool `json:"pending"`
+
+	// LastPushAt is when the repository was last successfully pushed.
+	//
+	LastPushAt *time.Time `json:"lastPushAt,omitempty"`
+
+	// Attempts is how many times pushing the pending changes failed.
+	//
+	Attempts int `json:"attempts,omitempty"`
+
+	// Error is why the last attempt failed, if it did.
+	//
+	Error string `json:"error,omitempty"`
+
+	// NextAttemptAt is when pending changes are going to be pushed next.
+	//
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+
+	inflight bool
+}
+
+// PushMirrors replicates repositories to the remotes in a configuration
+// file (reloaded whenever it changes) after each push that updates their
+// refs, retrying failed pushes with exponential backoff.
+//
+// As pushes replicate the whole repository, those that happen while
+// replication is pending get coalesced into a single one. Pending
+// replications aren't persisted: instead, every repository is pushed to its
+// mirrors once at startup.
+//
+// A nil PushMirrors replicates nothing.
+//
+type PushMirrors struct {
+	ConfigFilepath        string
+	DataDirectory         string
+	GitExecutableFilepath string
+
+	// InitialBackoff is how long to wait before retrying a push for the
+	// first time, doubling at each subsequent attempt (defaults to a
+	// second).
+	//
+	InitialBackoff time.Duration
+
+	logger   *log.Logger
+	config   atomic.Value // *PushMirrorsConfig
+	watcher  *fileWatcher
+	wakeCh   chan struct{}
+	mu       sync.Mutex
+	statuses map[pushMirrorKey]*PushMirrorStatus
+}
+
+// Load loads the configuration for the first time, failing if it can't be
+// parsed.
+//
+func (m *PushMirrors) Load(ctx context.Context) error {
+	m.logger = log.From(ctx)
+	m.wakeCh = make(chan struct{}, 1)
+	m.statuses = map[pushMirrorKey]*PushMirrorStatus{}
+
+	if m.InitialBackoff == 0 {
+		m.InitialBackoff = time.Second
+	}
+
+	m.watcher = &fileWatcher{
+		Filepath: m.ConfigFilepath,
+		OnChange: m.setConfig,
+	}
+
+	if err := m.watcher.Load(); err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+
+	return nil
+}
+
+// Run pushes repositories to their mirrors as they get pushed to (and
+// retries those that failed) until the context is cancelled.
+//
+func (m *PushMirrors) Run(ctx context.Context) error {
+	go m.watcher.Run(ctx)
+
+	for _, mirror := range m.loadConfig().PushMirrors {
+		repo, err := resolveRepository(m.DataDirectory, mirror.Repository)
+		if err != nil {
+			continue
+		}
+
+		if isBare, _ := isBareRepository(repo.Directory); isBare {
+			m.enqueue(repo.Name)
+		}
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		for _, mirror := range m.duePushMirrors(time.Now()) {
+			wg.Add(1)
+			go func(mirror PushMirror) {
+				defer wg.Done()
+				m.push(ctx, mirror)
+			}(mirror)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-m.wakeCh:
+		}
+	}
+}
+
+// Statuses lists, by repository and url, the status of the push mirrors of
+// the repositories that `filter` accepts.
+//
+func (m *PushMirrors) Statuses(filter func(repo string) bool) []PushMirrorStatus {
+	if m == nil {
+		return []PushMirrorStatus{}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := []PushMirrorStatus{}
+	for _, mirror := range m.loadConfig().PushMirrors {
+		if !filter(mirror.Repository) {
+			continue
+		}
+
+		status := PushMirrorStatus{Repository: mirror.Repository, URL: redactURL(mirror.URL)}
+		if s, found := m.statuses[pushMirrorKey{mirror.Repository, mirror.URL}]; found {
+			status = *s
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Repository != statuses[j].Repository {
+			return statuses[i].Repository < statuses[j].Repository
+		}
+
+		return statuses[i].URL < statuses[j].URL
+	})
+
+	return statuses
+}
+
+// pushMirrorTracker captures the refs of a repository before a push so
+// that, once it's done, the repository gets replicated if they changed.
+//
+type pushMirrorTracker struct {
+	mirrors *PushMirrors
+	repo    *repository
+	before  refs
+}
+
+// track starts tracking a push to `repo`, returning nil if it has no push
+// mirrors.
+//
+func (m *PushMirrors) track(repo *repository) *pushMirrorTracker {
+	if m == nil || !m.hasPushMirrorsFor(repo.Name) {
+		return nil
+	}
+
+	before, err := snapshotRefs(repo.Directory)
+	if err != nil {
+		m.logger.WithError(err).
+			WithField("repository", repo.Name).
+			Error("snapshot refs")
+
+		return nil
+	}
+
+	return &pushMirrorTracker{
+		mirrors: m,
+		repo:    repo,
+		before:  before,
+	}
+}
+
+// done queues the replication of the repository if the push updated any
+// of its refs.
+//
+func (t *pushMirrorTracker) done() {
+	if t == nil {
+		return
+	}
+
+	after, err := snapshotRefs(t.repo.Directory)
+	if err != nil {
+		t.mirrors.logger.WithError(err).
+			WithField("repository", t.repo.Name).
+			Error("snapshot refs")
+		return
+	}
+
+	if len(diffRefs(t.before, after)) == 0 {
+		return
+	}
+
+	t.mirrors.enqueue(t.repo.Name)
+}
+
+// enqueue marks every push mirror of `repo` as pending, due right away.
+//
+func (m *PushMirrors) enqueue(repo string) {
+	now := time.Now()
+
+	m.mu.Lock()
+	for _, mirror := range m.loadConfig().PushMirrors {
+		if mirror.Repository != repo {
+			continue
+		}
+
+		status := m.status(mirror)
+		status.Pending = true
+		status.Attempts = 0
+		status.NextAttemptAt = &now
+	}
+	m.mu.Unlock()
+
+	select {
+	case m.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// duePushMirrors marks as inflight, and returns, the push mirrors with
+// pending changes whose next attempt is due.
+//
+func (m *PushMirrors) duePushMirrors(now time.Time) []PushMirror {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	due := []PushMirror{}
+	for _, mirror := range m.loadConfig().PushMirrors {
+		status, found := m.statuses[pushMirrorKey{mirror.Repository, mirror.URL}]
+		if !found || !status.Pending || status.inflight {
+			continue
+		}
+
+		if status.NextAttemptAt != nil && now.Before(*status.NextAttemptAt) {
+			continue
+		}
+
+		// changes that come in from now on need another push.
+		//
+		status.Pending = false
+		status.inflight = true
+		due = append(due, mirror)
+	}
+
+	return due
+}
+
+func (m *PushMirrors) push(ctx context.Context, mirror PushMirror) {
+	logger := m.logger.WithFields(log.Fields{
+		"repository": mirror.Repository,
+		"url":        redactURL(mirror.URL),
+	})
+
+	started := time.Now()
+	err := pushMirror(ctx, m.GitExecutableFilepath, m.DataDirectory, mirror)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := m.status(mirror)
+	status.inflight = false
+
+	now := time.Now()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			status.Pending = true
+			return
+		}
+
+		status.Pending = true
+		status.Attempts++
+		status.Error = strings.ReplaceAll(err.Error(), mirror.URL, redactURL(mirror.URL))
+
+		nextAttemptAt := now.Add(m.backoff(status.Attempts))
+		status.NextAttemptAt = &nextAttemptAt
+
+		pushMirrorPushes.WithLabelValues(mirror.Repository, pushMirrorPushFailed).Inc()
+		logger.WithError(err).WithFields(log.Fields{
+			"attempts":     status.Attempts,
+			"next-attempt": nextAttemptAt,
+		}).Error("push")
+		return
+	}
+
+	status.Attempts = 0
+	status.Error = ""
+	status.LastPushAt = &now
+	if !status.Pending {
+		status.NextAttemptAt = nil
+	}
+
+	pushMirrorPushes.WithLabelValues(mirror.Repository, pushMirrorPushSucceeded).Inc()
+	logger.WithField("duration", now.Sub(started)).Info("pushed")
+}
+
+// backoff is how long to wait before the next attempt after `attempts`
+// failed ones.
+//
+func (m *PushMirrors) backoff(attempts int) time.Duration {
+	backoff := m.InitialBackoff
+	for i := 1; i < attempts && backoff < pushMirrorMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > pushMirrorMaxBackoff {
+		return pushMirrorMaxBackoff
+	}
+
+	return backoff
+}
+
+// pushMirror pushes every ref of the repository to the mirror, pruning
+// those that no longer exist in the repository.
+//
+func pushMirror(ctx context.Context, git, root string, mirror PushMirror) error {
+	ctx, cancel := context.WithTimeout(ctx, pushMirrorTimeout)
+	defer cancel()
+
+	repo, err := resolveRepository(root, mirror.Repository)
+	if err != nil {
+		return fmt.Errorf("resolve: %w", err)
+	}
+
+	isBare, err := isBareRepository(repo.Directory)
+	if err != nil {
+		return fmt.Errorf("is bare check: %w", err)
+	}
+
+	if !isBare {
+		return fmt.Errorf("%w: '%s'", errRepositoryNotFound, repo.Name)
+	}
+
+	cmd := exec.CommandContext(ctx, git, "push", "--quiet", "--mirror", mirror.URL)
+	cmd.Dir = repo.Directory
+	cmd.Env = mirror.env()
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("push: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// status is the status of `mirror`, created if it doesn't exist yet - must
+// be called with the lock held.
+//
+func (m *PushMirrors) status(mirror PushMirror) *PushMirrorStatus {
+	key := pushMirrorKey{mirror.Repository, mirror.URL}
+
+	status, found := m.statuses[key]
+	if !found {
+		status = &PushMirrorStatus{Repository: mirror.Repository, URL: redactURL(mirror.URL)}
+		m.statuses[key] = status
+	}
+
+	return status
+}
+
+func (m *PushMirrors) hasPushMirrorsFor(repo string) bool {
+	for _, mirror := range m.loadConfig().PushMirrors {
+		if mirror.Repository == repo {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *PushMirrors) setConfig(content []byte) error {
+	config, err := ParsePushMirrorsConfig(content)
+	if err != nil {
+		return fmt.Errorf("parse push mirrors config: %w", err)
+	}
+
+	m.config.Store(config)
+	m.logger.WithField("push-mirrors", len(config.PushMirrors)).Info("loaded push mirrors")
+
+	return nil
+}
+
+func (m *PushMirrors) loadConfig() *PushMirrorsConfig {
+	config, _ := m.config.Load().(*PushMirrorsConfig)
+	if config == nil {
+		return &PushMirrorsConfig{}
+	}
+
+	return config
+}
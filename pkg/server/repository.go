@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+var (
+	errInvalidRepositoryName = errors.New("invalid repository name")
+	errRepositoryNotFound    = errors.New("repository not found")
+)
+
+// AutoCreatePolicy determines whether a repository that doesn't exist yet
+// gets created when a client first tries to access it.
+//
+type AutoCreatePolicy string
+
+const (
+	// AutoCreateNever never creates repositories on access - they must
+	// exist beforehand.
+	//
+	AutoCreateNever AutoCreatePolicy = "never"
+
+	// AutoCreateOnPush creates repositories only when they're pushed to
+	// (i.e., on `git-receive-pack`).
+	//
+	AutoCreateOnPush AutoCreatePolicy = "on-push"
+
+	// AutoCreateAlways creates repositories on any access, including
+	// clones and fetches.
+	//
+	AutoCreateAlways AutoCreatePolicy = "always"
+)
+
+// ParseAutoCreatePolicy parses the textual representation of a policy
+// (`never`, `on-push`, or `always`).
+//
+func ParseAutoCreatePolicy(v string) (AutoCreatePolicy, error) {
+	switch policy := AutoCreatePolicy(v); policy {
+	case AutoCreateNever, AutoCreateOnPush, AutoCreateAlways:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("unknown auto-create policy '%s' "+
+		"(expected never, on-push, or always)", v,
+	)
+}
+
+// allows tells whether a missing repository should be created for a client
+// trying to run `service` against it. An empty policy behaves like
+// AutoCreateAlways.
+//
+func (p AutoCreatePolicy) allows(service gitService) bool {
+	switch p {
+	case AutoCreateNever:
+		return false
+	case AutoCreateOnPush:
+		return service == serviceReceivePack
+	}
+
+	return true
+}
+
+// repository is a repository that a client referred to, already confined to
+// the data directory.
+//
+type repository struct {
+	// Name is the normalized name of the repository, relative to the data
+	// directory (e.g., `team/foo.git`).
+	//
+	Name string
+
+	// Directory is the absolute path to the repository in the
+	// filesystem.
+	//
+	Directory string
+}
+
+// resolveRepository normalizes the name of a repository as provided by a
+// client (through an URL or SSH command) and resolves it to a directory
+// under `root`, ensuring that neither the name nor symlinks along the way
+// lead to a place outside of it.
+//
+func resolveRepository(root, name string) (*repository, error) {
+	normalized, err := normalizeRepositoryName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("abs '%s': %w", root, err)
+	}
+
+	dir := filepath.Join(root, filepath.FromSlash(normalized))
+	if err := ensureWithinRoot(root, dir); err != nil {
+		return nil, err
+	}
+
+	return &repository{
+		Name:      normalized,
+		Directory: dir,
+	}, nil
+}
+
+// openRepository makes sure that the repository exists before `service` is
+// run against it, creating it (with the hooks installed) if the policy
+// allows (with `backend`), or failing with errRepositoryNotFound otherwise.
+//
+func openRepository(repo *repository, service gitService, policy AutoCreatePolicy, hooks *Hooks, backend Backend) error {
+	isBare, err := isBareRepository(repo.Directory)
+	if err != nil {
+		return fmt.Errorf("is bare check: %w", err)
+	}
+
+	if isBare {
+		return nil
+	}
+
+	if !policy.allows(service) {
+		return fmt.Errorf("%w: '%s'", errRepositoryNotFound, repo.Name)
+	}
+
+	err = initDirAsBareRepository(repo.Directory, backend)
+	if err != nil {
+		return fmt.Errorf("init dir as bare repo: %w", err)
+	}
+
+	if err := hooks.Install(repo.Directory); err != nil {
+		return fmt.Errorf("install hooks: %w", err)
+	}
+
+	return nil
+}
+
+// normalizeRepositoryName strips leading `/` and `~` from a name, makes sure
+// it ends with `.git` and rejects those that could be used to refer to
+// something other than a repository under the data directory.
+//
+func normalizeRepositoryName(name string) (string, error) {
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("%w: control characters are not allowed",
+				errInvalidRepositoryName,
+			)
+		}
+	}
+
+	name = strings.TrimLeft(name, "/~")
+
+	segments := []string{}
+	for _, segment := range strings.Split(name, "/") {
+		switch segment {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("%w: '..' is not allowed",
+				errInvalidRepositoryName,
+			)
+		}
+
+		segments = append(segments, segment)
+	}
+
+	name = strings.Join(segments, "/")
+	if !strings.HasSuffix(name, ".git") {
+		name += ".git"
+	}
+
+	if name == ".git" || strings.HasSuffix(name, "/.git") {
+		return "", fmt.Errorf("%w: empty name", errInvalidRepositoryName)
+	}
+
+	return name, nil
+}
+
+// ensureWithinRoot verifies that the deepest existing ancestor of `dir` (or
+// `dir` itself), once symlinks are evaluated, is still under `root`.
+//
+func ensureWithinRoot(root, dir string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return fmt.Errorf("eval symlinks '%s': %w", root, err)
+	}
+
+	for path := dir; ; path = filepath.Dir(path) {
+		realPath, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return fmt.Errorf("eval symlinks '%s': %w", path, err)
+			}
+
+			if path == root || filepath.Dir(path) == path {
+				return nil
+			}
+
+			continue
+		}
+
+		rel, err := filepath.Rel(realRoot, realPath)
+		if err != nil {
+			return fmt.Errorf("rel '%s': %w", realPath, err)
+		}
+
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%w: resolves to outside of the data directory",
+				errInvalidRepositoryName,
+			)
+		}
+
+		return nil
+	}
+}
+
+type repositoryCtxKey struct{}
+
+func withRepository(ctx context.Context, repo *repository) context.Context {
+	return context.WithValue(ctx, repositoryCtxKey{}, repo)
+}
+
+func repositoryFrom(ctx context.Context) *repository {
+	repo, _ := ctx.Value(repositoryCtxKey{}).(*repository)
+	return repo
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeRepositoryName(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		normalized string
+		invalid    bool
+	}{
+		{name: "foo", normalized: "foo.git"},
+		{name: "foo.git", normalized: "foo.git"},
+		{name: "/foo.git", normalized: "foo.git"},
+		{name: "~/foo.git", normalized: "foo.git"},
+		{name: "/~foo", normalized: "foo.git"},
+		{name: "team/foo", normalized: "team/foo.git"},
+		{name: "team//foo.git", normalized: "team/foo.git"},
+		{name: "./team/./foo.git", normalized: "team/foo.git"},
+		{name: "team/foo.git/", normalized: "team/foo.git"},
+
+		{name: "", invalid: true},
+		{name: "/", invalid: true},
+		{name: ".git", invalid: true},
+		{name: "team/.git", invalid: true},
+		{name: "..", invalid: true},
+		{name: "../foo.git", invalid: true},
+		{name: "team/../../foo.git", invalid: true},
+		{name: "foo\n.git", invalid: true},
+		{name: "foo\x00.git", invalid: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			normalized, err := normalizeRepositoryName(tc.name)
+			if tc.invalid {
+				if !errors.Is(err, errInvalidRepositoryName) {
+					t.Fatalf("expected invalid name, got '%s' (%v)", normalized, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if normalized != tc.normalized {
+				t.Fatalf("expected '%s', got '%s'", tc.normalized, normalized)
+			}
+		})
+	}
+}
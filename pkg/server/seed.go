@@ -0,0 +1,600 @@
+package server
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+// seedCommitMessage is the message of the commit made out of the files of
+// a tarball or plain directory.
+//
+const seedCommitMessage = "initial commit"
+
+// RepositoriesConfig declares repositories that must exist, and what they
+// should be seeded with when they get created.
+//
+type RepositoriesConfig struct {
+	Repositories []RepositorySpec `json:"repositories"`
+}
+
+type RepositorySpec struct {
+	// Name is the name of the repository (e.g., `team/foo.git`).
+	//
+	Name string `json:"name"`
+
+	// DefaultBranch is the branch that HEAD points at (default: git's
+	// own default, or the source's HEAD when seeded from a repository).
+	//
+	DefaultBranch string `json:"defaultBranch,omitempty"`
+
+	// Source, if set, is what the repository is seeded with.
+	//
+	Source *RepositorySource `json:"source,omitempty"`
+}
+
+// RepositorySource is where the initial contents of a repository come
+// from - exactly one of the fields must be set.
+//
+type RepositorySource struct {
+	// Tarball is the path to a (possibly gzipped) tarball of files to be
+	// committed to the default branch.
+	//
+	Tarball string `json:"tarball,omitempty"`
+
+	// Path is the path to a directory: a repository (bare or not) to
+	// fetch the branches and tags from, or otherwise plain files to be
+	// committed to the default branch.
+	//
+	Path string `json:"path,omitempty"`
+
+	// Bundle is the path to a bundle (`git bundle create`) to fetch the
+	// branches and tags from.
+	//
+	Bundle string `json:"bundle,omitempty"`
+}
+
+// RepositoryStatus is the outcome of making sure that a declared
+// repository exists.
+//
+type RepositoryStatus struct {
+	Name string `json:"name"`
+
+	// Created tells whether the repository exists - either created just
+	// now, or before.
+	//
+	Created bool `json:"created"`
+
+	// Seeded tells whether the repository got seeded just now, i.e., it
+	// didn't exist before.
+	//
+	Seeded bool `json:"seeded,omitempty"`
+
+	// Head is the commit that HEAD points at, if any.
+	//
+	Head string `json:"head,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// ParseRepositoriesConfig parses the repositories configuration in either
+// YAML or JSON.
+//
+func ParseRepositoriesConfig(content []byte) (*RepositoriesConfig, error) {
+	config := &RepositoriesConfig{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	seen := map[string]bool{}
+	for idx, spec := range config.Repositories {
+		name, err := normalizeRepositoryName(spec.Name)
+		if err != nil {
+			return nil, fmt.Errorf("repository %d: %w", idx, err)
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("repository %d: '%s' declared more "+
+				"than once", idx, name,
+			)
+		}
+		seen[name] = true
+
+		if spec.Source == nil {
+			continue
+		}
+
+		count := 0
+		for _, field := range []string{
+			spec.Source.Tarball, spec.Source.Path, spec.Source.Bundle,
+		} {
+			if field != "" {
+				count++
+			}
+		}
+
+		if count != 1 {
+			return nil, fmt.Errorf("repository %d: source must have "+
+				"exactly one of tarball, path, or bundle", idx,
+			)
+		}
+	}
+
+	return config, nil
+}
+
+// LoadRepositoriesConfig reads and parses the repositories configuration
+// at `fpath`.
+//
+func LoadRepositoriesConfig(fpath string) (*RepositoriesConfig, error) {
+	content, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("read file '%s': %w", fpath, err)
+	}
+
+	config, err := ParseRepositoriesConfig(content)
+	if err != nil {
+		return nil, fmt.Errorf("parse '%s': %w", fpath, err)
+	}
+
+	return config, nil
+}
+
+// SeedRepositories makes sure that every repository in the configuration
+// exists under `root`, creating (with the hooks installed) and seeding
+// those that don't (executing `git`). Repositories that already exist are
+// left untouched, so that nothing pushed to them is ever lost.
+//
+// Failing to create one repository doesn't prevent the others from being
+// created: the error is reported in its status, with SeedRepositories
+// erroring at the end.
+//
+func SeedRepositories(ctx context.Context, git, root string, config *RepositoriesConfig, hooks *Hooks) ([]RepositoryStatus, error) {
+	logger := log.From(ctx)
+
+	statuses := []RepositoryStatus{}
+	failed := 0
+
+	for _, spec := range config.Repositories {
+		status, err := seedRepository(git, root, spec, hooks)
+		if err != nil {
+			failed++
+			status.Error = err.Error()
+
+			logger.WithError(err).
+				WithField("repository", status.Name).
+				Error("seed")
+		} else {
+			logger.WithFields(log.Fields{
+				"repository": status.Name,
+				"seeded":     status.Seeded,
+				"head":       status.Head,
+			}).Info("repository ready")
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	if failed > 0 {
+		return statuses, fmt.Errorf("%d out of %d repositories failed",
+			failed, len(statuses),
+		)
+	}
+
+	return statuses, nil
+}
+
+func seedRepository(git, root string, spec RepositorySpec, hooks *Hooks) (RepositoryStatus, error) {
+	status := RepositoryStatus{Name: spec.Name}
+
+	repo, err := resolveRepository(root, spec.Name)
+	if err != nil {
+		return status, fmt.Errorf("resolve: %w", err)
+	}
+
+	status.Name = repo.Name
+
+	isBare, err := isBareRepository(repo.Directory)
+	if err != nil {
+		return status, fmt.Errorf("is bare check: %w", err)
+	}
+
+	if !isBare {
+		if err := createSeededRepository(git, repo, spec); err != nil {
+			return status, err
+		}
+
+		status.Seeded = true
+	}
+
+	if err := hooks.Install(repo.Directory); err != nil {
+		return status, fmt.Errorf("install hooks: %w", err)
+	}
+
+	status.Created = true
+	status.Head = resolveHead(git, repo.Directory)
+
+	return status, nil
+}
+
+// createSeededRepository creates the repository, seeding it with what the
+// spec declares.
+//
+func createSeededRepository(git string, repo *repository, spec RepositorySpec) error {
+	return createRepositoryAtomically(git, repo, func(dir string) error {
+		if spec.DefaultBranch != "" {
+			ref := "refs/heads/" + spec.DefaultBranch
+			if out, err := execAt(dir, git, "symbolic-ref", "HEAD", ref); err != nil {
+				return fmt.Errorf("symbolic-ref HEAD '%s': %w: %s", ref, err, out)
+			}
+		}
+
+		if spec.Source != nil {
+			if err := seed(git, dir, spec); err != nil {
+				return fmt.Errorf("seed: %w", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// createRepositoryAtomically creates the repository in a temporary
+// directory next to where it should end up, only moving it into place once
+// `populate` is done with it, so that a failure doesn't leave a
+// half-populated repository behind (that would then be taken as already
+// existing).
+//
+func createRepositoryAtomically(git string, repo *repository, populate func(dir string) error) error {
+	parent := filepath.Dir(repo.Directory)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("mkdir '%s': %w", parent, err)
+	}
+
+	if _, err := os.Stat(repo.Directory); err == nil {
+		return fmt.Errorf("'%s' exists but is not a bare repository",
+			repo.Directory,
+		)
+	}
+
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(repo.Directory)+".tmp-")
+	if err != nil {
+		return fmt.Errorf("mkdir temp: %w", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := initBareRepository(git, tmp); err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+
+	if err := populate(tmp); err != nil {
+		return err
+	}
+
+	// the temp dir gets created with 0700.
+	//
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return fmt.Errorf("chmod '%s': %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, repo.Directory); err != nil {
+		return fmt.Errorf("rename '%s': %w", tmp, err)
+	}
+
+	return nil
+}
+
+func seed(git, dir string, spec RepositorySpec) error {
+	source := spec.Source
+
+	switch {
+	case source.Bundle != "":
+		return fetchAll(git, dir, source.Bundle, spec.DefaultBranch)
+
+	case source.Path != "":
+		isRepo, err := isRepository(source.Path)
+		if err != nil {
+			return err
+		}
+
+		if isRepo {
+			return fetchAll(git, dir, source.Path, spec.DefaultBranch)
+		}
+
+		return commitDirectory(git, dir, source.Path)
+
+	case source.Tarball != "":
+		files, err := os.MkdirTemp("", "git-serve-seed-")
+		if err != nil {
+			return fmt.Errorf("mkdir temp: %w", err)
+		}
+		defer os.RemoveAll(files)
+
+		if err := extractTarball(source.Tarball, files); err != nil {
+			return fmt.Errorf("extract '%s': %w", source.Tarball, err)
+		}
+
+		return commitDirectory(git, dir, files)
+	}
+
+	return nil
+}
+
+// isRepository tells whether `path` is a repository, either bare or with a
+// `.git` directory in it (not looking further up, unlike git itself).
+//
+func isRepository(path string) (bool, error) {
+	if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+		return true, nil
+	}
+
+	isBare, err := isBareRepository(path)
+	if err != nil {
+		return false, fmt.Errorf("is bare check: %w", err)
+	}
+
+	return isBare, nil
+}
+
+// fetchAll fetches every branch and tag from `source` (a repository or
+// bundle), pointing HEAD at the same branch as the source's HEAD if no
+// default branch was asked for.
+//
+func fetchAll(git, dir, source, defaultBranch string) error {
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return fmt.Errorf("abs '%s': %w", source, err)
+	}
+
+	out, err := execAt(dir, git, "fetch", "--quiet", source,
+		"+refs/heads/*:refs/heads/*",
+		"+refs/tags/*:refs/tags/*",
+	)
+	if err != nil {
+		return fmt.Errorf("fetch '%s': %w: %s", source, err, out)
+	}
+
+	if defaultBranch != "" {
+		return nil
+	}
+
+	branch, err := remoteHeadBranch(git, dir, source)
+	if err != nil {
+		return fmt.Errorf("remote head '%s': %w", source, err)
+	}
+
+	if branch == "" {
+		return nil
+	}
+
+	if out, err := execAt(dir, git, "symbolic-ref", "HEAD", branch); err != nil {
+		return fmt.Errorf("symbolic-ref HEAD '%s': %w: %s", branch, err, out)
+	}
+
+	return nil
+}
+
+// remoteHeadBranch figures out the branch that HEAD points at in `source`:
+// directly for repositories, or through the branches pointing at the same
+// commit as HEAD for bundles (which don't keep track of symbolic refs).
+//
+func remoteHeadBranch(git, dir, source string) (string, error) {
+	out, err := execAt(dir, git, "ls-remote", "--symref", source)
+	if err != nil {
+		return "", fmt.Errorf("ls-remote: %w: %s", err, out)
+	}
+
+	var (
+		head     string
+		branches = []string{}
+		objects  = map[string]string{}
+	)
+
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+
+		if fields[0] == "ref:" {
+			if strings.HasPrefix(fields[1], "refs/heads/") {
+				return fields[1], nil
+			}
+
+			continue
+		}
+
+		obj, ref := fields[0], fields[1]
+		switch {
+		case ref == "HEAD":
+			head = obj
+		case strings.HasPrefix(ref, "refs/heads/"):
+			branches = append(branches, ref)
+			objects[ref] = obj
+		}
+	}
+
+	for _, branch := range branches {
+		if objects[branch] == head {
+			return branch, nil
+		}
+	}
+
+	return "", nil
+}
+
+// commitDirectory commits the files under `files` to the branch that HEAD
+// points at in the bare repository at `dir`.
+//
+func commitDirectory(git, dir, files string) error {
+	files, err := filepath.Abs(files)
+	if err != nil {
+		return fmt.Errorf("abs '%s': %w", files, err)
+	}
+
+	index, err := os.CreateTemp("", "git-serve-index-")
+	if err != nil {
+		return fmt.Errorf("create temp: %w", err)
+	}
+	index.Close()
+	os.Remove(index.Name())
+	defer os.Remove(index.Name())
+
+	env := gitEnv(
+		"GIT_DIR="+dir,
+		"GIT_WORK_TREE="+files,
+		"GIT_INDEX_FILE="+index.Name(),
+		"GIT_AUTHOR_NAME=git-serve",
+		"GIT_AUTHOR_EMAIL=git-serve@localhost",
+		"GIT_COMMITTER_NAME=git-serve",
+		"GIT_COMMITTER_EMAIL=git-serve@localhost",
+	)
+
+	run := func(args ...string) (string, error) {
+		cmd := exec.Command(git, args...)
+		cmd.Dir = files
+		cmd.Env = env
+
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%s: %w: %s", args[0], err, stderr)
+		}
+
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	if _, err := run("add", "--all", "."); err != nil {
+		return err
+	}
+
+	tree, err := run("write-tree")
+	if err != nil {
+		return err
+	}
+
+	commit, err := run("commit-tree", "-m", seedCommitMessage, tree)
+	if err != nil {
+		return err
+	}
+
+	if _, err := run("update-ref", "HEAD", commit); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// extractTarball extracts the regular files, directories, and symlinks of
+// a (possibly gzipped) tarball into `dir`, refusing entries that would
+// end up outside of it.
+//
+func extractTarball(fpath, dir string) error {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	var archive io.Reader = r
+	if magic, err := r.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("gzip: %w", err)
+		}
+		defer gz.Close()
+
+		archive = gz
+	}
+
+	tr := tar.NewReader(archive)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return fmt.Errorf("next: %w", err)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(header.Name))
+		if target == dir {
+			continue
+		}
+
+		if err := ensureWithinRoot(dir, target); err != nil ||
+			!strings.HasPrefix(target, dir+string(filepath.Separator)) {
+			return fmt.Errorf("entry '%s' escapes the archive", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("mkdir '%s': %w", target, err)
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("mkdir '%s': %w", filepath.Dir(target), err)
+			}
+
+			if err := writeTarEntry(tr, target, header.FileInfo().Mode()); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("mkdir '%s': %w", filepath.Dir(target), err)
+			}
+
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return fmt.Errorf("symlink '%s': %w", target, err)
+			}
+		}
+	}
+}
+
+func writeTarEntry(r io.Reader, target string, mode os.FileMode) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return fmt.Errorf("open '%s': %w", target, err)
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("copy to '%s': %w", target, err)
+	}
+
+	return nil
+}
+
+// resolveHead is the commit that HEAD points at in the repository at
+// `dir`, or empty if none (e.g., no commits yet).
+//
+func resolveHead(git, dir string) string {
+	out, err := execAt(dir, git, "rev-parse", "--verify", "--quiet", "HEAD")
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
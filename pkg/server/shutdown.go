@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+const (
+	// ShutdownDefaultTimeout is how long servers wait for the operations
+	// in flight to finish once they're asked to stop, before terminating
+	// them - short enough for stragglers to be killed within kubernetes'
+	// default grace period of 30s.
+	//
+	ShutdownDefaultTimeout = 20 * time.Second
+
+	// shutdownKillDelay is how long the processes of operations that
+	// didn't finish in time have to exit after SIGTERM, before SIGKILL.
+	//
+	shutdownKillDelay = 5 * time.Second
+)
+
+// inflight keeps track of the git operations in progress so that they can
+// be terminated if they don't finish by the time a server is done
+// draining.
+//
+type inflight struct {
+	mu         sync.Mutex
+	operations map[*operation]func(syscall.Signal)
+}
+
+// track registers an operation along with how to signal its git process,
+// returning a function to deregister it once it's done.
+//
+func (f *inflight) track(op *operation, signal func(syscall.Signal)) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.operations == nil {
+		f.operations = map[*operation]func(syscall.Signal){}
+	}
+
+	f.operations[op] = signal
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		delete(f.operations, op)
+	}
+}
+
+// signal sends `sig` to the git processes of every operation in flight,
+// telling how many there were.
+//
+func (f *inflight) signal(logger *log.Logger, sig syscall.Signal) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for op, signal := range f.operations {
+		logger.WithFields(log.Fields{
+			"identity":   op.identity,
+			"repository": op.repository,
+			"service":    op.service,
+			"signal":     sig,
+			"transport":  op.transport,
+		}).Warn("interrupting")
+
+		signal(sig)
+	}
+
+	return len(f.operations)
+}
+
+// drain gracefully shuts a server down: once `shutdown` stops it from
+// accepting new connections, operations in flight get up to `timeout` to
+// finish, after which their git processes are sent SIGTERM and,
+// shutdownKillDelay later, SIGKILL - with `close` then forcibly closing
+// whatever connections are left.
+//
+// The signal-handling context is already cancelled by then, so draining
+// happens on a context of its own.
+//
+func drain(logger *log.Logger, timeout time.Duration, operations *inflight,
+	shutdown func(context.Context) error, close func() error,
+) error {
+	logger.WithField("timeout", timeout).Info("draining")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		if operations.signal(logger, sig) == 0 {
+			break
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownKillDelay)
+		err = shutdown(ctx)
+		cancel()
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+	}
+
+	if err := close(); err != nil {
+		return fmt.Errorf("close: %w", err)
+	}
+
+	return nil
+}
@@ -3,15 +3,21 @@ package server
 import (
 	"context"
 	_ "embed"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/gliderlabs/ssh"
-	"github.com/google/shlex"
+	gossh "golang.org/x/crypto/ssh"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/cirocosta/git-serve/pkg/log"
@@ -23,19 +29,35 @@ import (
 //
 const SSHDefaultBindAddress = ":2222"
 
+// errInternal is what clients are told when their session fails on the
+// server's side, with the details left to the server's logs.
+//
+var errInternal = errors.New("internal server error")
+
 //go:embed default_host_key.txt
 var defaultHostKey []byte
 
 type SSHServer struct {
+	AccessLog              *AccessLog
 	AuthorizedKeysFilepath string
+	Authorizer             *Authorizer
+	AutoCreate             AutoCreatePolicy
+	Backend                Backend
 	BindAddress            string
 	DataDirectory          string
-	GitExecutableFilepath  string
 	HostKeyFilepath        string
+	Health                 *Health
+	Hooks                  *Hooks
+	Mirrors                *Mirrors
 	NoAuth                 bool
+	Notifier               *Notifier
+	PushMirrors            *PushMirrors
+	ShutdownTimeout        time.Duration
 
 	logger         *log.Logger
-	authorizedKeys []ssh.PublicKey
+	operations     inflight
+	authorizedKeys atomic.Value // []*authorizedKey
+	watcher        *fileWatcher
 }
 
 func (s *SSHServer) Run(ctx context.Context) error {
@@ -43,6 +65,7 @@ func (s *SSHServer) Run(ctx context.Context) error {
 
 	s.logger.WithFields(log.Fields{
 		"authorized-keys": s.AuthorizedKeysFilepath,
+		"auto-create":     s.AutoCreate,
 		"bind-addr":       s.BindAddress,
 		"host-key":        s.HostKeyFilepath,
 		"no-auth":         s.NoAuth,
@@ -54,37 +77,73 @@ func (s *SSHServer) Run(ctx context.Context) error {
 		return fmt.Errorf("server: %w", err)
 	}
 
+	if s.watcher != nil {
+		go s.watcher.Run(ctx)
+	}
+
+	listener, err := net.Listen("tcp", s.BindAddress)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	s.Health.setSSHListening(true)
+	defer s.Health.setSSHListening(false)
+
 	doneCh := make(chan error, 1)
 	go func() {
-		doneCh <- server.ListenAndServe()
+		doneCh <- server.Serve(listener)
 	}()
 
 	select {
 	case <-ctx.Done():
-		return server.Shutdown(ctx)
+		s.Health.setSSHListening(false)
+
+		return drain(s.logger, s.ShutdownTimeout, &s.operations,
+			server.Shutdown, server.Close,
+		)
 	case err := <-doneCh:
 		return err
 	}
 }
 
-func (s *SSHServer) loadAuthorizedKeys() error {
-	content, err := os.ReadFile(s.AuthorizedKeysFilepath)
-	if err != nil {
-		return fmt.Errorf("read file '%s': %w",
-			s.AuthorizedKeysFilepath, err,
-		)
+// setAuthorizedKeys parses the contents of an authorized keys file and
+// atomically swaps the set of keys that are authorized by the new one,
+// leaving out (and logging) those with options that can't be honored.
+//
+func (s *SSHServer) setAuthorizedKeys(content []byte) error {
+	keys, invalid := parseAuthorizedKeys(content)
+	for _, err := range invalid {
+		s.logger.WithError(err).Warn("skipping authorized key")
 	}
 
-	pk, _, _, _, err := ssh.ParseAuthorizedKey(content)
-	if err != nil {
-		return fmt.Errorf("parse auth key: %w", err)
-	}
+	before := authorizedKeyNames(s.loadAuthorizedKeys())
+	s.authorizedKeys.Store(keys)
 
-	s.authorizedKeys = append(s.authorizedKeys, pk)
+	added, removed := diffNames(before, authorizedKeyNames(keys))
+	s.logger.WithFields(log.Fields{
+		"keys":    len(keys),
+		"added":   added,
+		"removed": removed,
+	}).Info("loaded authorized keys")
 
 	return nil
 }
 
+func (s *SSHServer) loadAuthorizedKeys() []*authorizedKey {
+	keys, _ := s.authorizedKeys.Load().([]*authorizedKey)
+	return keys
+}
+
+func authorizedKeyNames(keys []*authorizedKey) []string {
+	names := make([]string, 0, len(keys))
+	for _, key := range keys {
+		names = append(names, key.String())
+	}
+
+	sort.Strings(names)
+	return names
+}
+
 func (s *SSHServer) server() (*ssh.Server, error) {
 	var err error
 
@@ -96,7 +155,12 @@ func (s *SSHServer) server() (*ssh.Server, error) {
 	if !s.NoAuth {
 		s.logger.Info("auth enabled")
 
-		err = s.loadAuthorizedKeys()
+		s.watcher = &fileWatcher{
+			Filepath: s.AuthorizedKeysFilepath,
+			OnChange: s.setAuthorizedKeys,
+		}
+
+		err = s.watcher.Load()
 		if err != nil {
 			return nil, fmt.Errorf("load authorized keys: %w", err)
 		}
@@ -105,6 +169,9 @@ func (s *SSHServer) server() (*ssh.Server, error) {
 		if err != nil {
 			return nil, fmt.Errorf("opt publickeyauth: %w", err)
 		}
+
+		server.PtyCallback = s.isPtyAllowed
+		server.ConnCallback = recordingAuthOutcome
 	}
 
 	hostKeyPEM := defaultHostKey
@@ -132,10 +199,27 @@ func (s *SSHServer) handleSession(session ssh.Session) {
 		"raw-cmd": session.RawCommand(),
 	})
 
+	var ctx context.Context = session.Context()
+
+	if !s.NoAuth {
+		key := s.authenticatedKey(session.Context())
+		if key == nil {
+			logger.Info("authenticated key no longer authorized")
+			rejectSession(session, errAccessDenied)
+			return
+		}
+
+		logger = logger.WithFields(log.Fields{
+			"identity":    key.Identity(),
+			"fingerprint": gossh.FingerprintSHA256(key.Key),
+		})
+		ctx = withAuthorizedKey(ctx, key)
+	}
+
 	logger.Debug("session start")
 	defer logger.Debug("session finished")
 
-	ctx := log.WithLogger(session.Context(), logger)
+	ctx = log.WithLogger(ctx, logger)
 
 	if err := s.runSessionCmd(ctx, session); err != nil {
 		s.logger.WithError(err).Error("run session cmd")
@@ -143,22 +227,60 @@ func (s *SSHServer) handleSession(session ssh.Session) {
 }
 
 func (s *SSHServer) runSessionCmd(ctx context.Context, session ssh.Session) error {
-	args, err := shlex.Split(session.RawCommand())
+	command, err := parseGitCommand(sessionCommand(ctx, session))
+	if err != nil {
+		rejectSession(session, err)
+		return fmt.Errorf("parse git command: %w", err)
+	}
+
+	identity := sessionIdentity(ctx)
+
+	repo, err := resolveRepository(s.DataDirectory, command.Repository)
 	if err != nil {
-		return fmt.Errorf("split: %w", err)
+		s.rejectCommand(session, command, command.Repository, identity, err)
+		return fmt.Errorf("resolve repository: %w", err)
+	}
+
+	if !s.Authorizer.Allows(identity, repo.Name, command.Service.access()) {
+		err = fmt.Errorf("%w: %s", errAccessDenied, repo.Name)
+		s.rejectCommand(session, command, repo.Name, identity, err)
+		recordAuthAttempt(transportSSH, authOutcomeDenied)
+
+		return err
 	}
 
-	repositoryDirectory := filepath.Join(s.DataDirectory, args[len(args)-1])
-	err = initDirAsBareRepository(repositoryDirectory)
+	policy, err := s.Mirrors.openPolicy(repo.Name, command.Service, s.AutoCreate)
 	if err != nil {
-		return fmt.Errorf("init dir as bar repo: %w", err)
+		s.rejectCommand(session, command, repo.Name, identity, err)
+		return err
 	}
 
-	args[len(args)-1] = repositoryDirectory
+	err = openRepository(repo, command.Service, policy, s.Hooks, s.Backend)
+	if err != nil {
+		if errors.Is(err, errRepositoryNotFound) {
+			s.rejectCommand(session, command, repo.Name, identity, err)
+		} else {
+			s.rejectCommand(session, command, repo.Name, identity, errInternal)
+		}
+
+		return fmt.Errorf("open repository: %w", err)
+	}
 
-	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd := s.Backend.Command(ctx, command.Service, repo.Directory, append(
+		hookEnv(identity, transportSSH, repo),
+		gitServiceEnv(sessionGitProtocol(session))...,
+	))
 	closers := []io.Closer{}
 
+	op := startOperation(transportSSH, command.Service, repo,
+		identity, session.RemoteAddr().String(),
+	)
+	exitCode := 1
+	defer func() {
+		op.finish(exitCode)
+		s.AccessLog.record(op, exitCode)
+	}()
+
 	var closeAll = func() {
 		for _, closer := range closers {
 			closer.Close()
@@ -168,41 +290,84 @@ func (s *SSHServer) runSessionCmd(ctx context.Context, session ssh.Session) erro
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
+		rejectSession(session, errInternal)
 		return fmt.Errorf("stdout pipe: %w", err)
 	}
 	closers = append(closers, stdout)
 
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
+		rejectSession(session, errInternal)
 		return fmt.Errorf("stderr pipe: %w", err)
 	}
 	closers = append(closers, stderr)
 
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
+		rejectSession(session, errInternal)
 		return fmt.Errorf("stdin pipe: %w", err)
 	}
 	closers = append(closers, stdin)
 
+	if command.Service == serviceReceivePack {
+		defer s.Notifier.track(repo, identity, transportSSH).done()
+		defer s.PushMirrors.track(repo).done()
+	}
+
 	eg, ctx := errgroup.WithContext(ctx)
 	if err = cmd.Start(); err != nil {
+		rejectSession(session, errInternal)
 		return fmt.Errorf("cmd start: %w", err)
 	}
 
+	exited := make(chan struct{})
+	signal := func(sig syscall.Signal) {
+		select {
+		case <-exited:
+		default:
+			cmd.Signal(sig)
+		}
+	}
+
+	defer s.operations.track(op, signal)()
+
+	// signals that the client sends are relayed to git, with it being hung
+	// up on if the client goes away (closing the channel, which makes
+	// writing to the session fail, or the connection) before it's done.
+	//
+	stopRelaying := relaySignals(session, signal)
+	defer stopRelaying()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			signal(syscall.SIGHUP)
+		case <-exited:
+		}
+	}()
+
 	eg.Go(func() error {
 		defer stdin.Close()
 
-		if _, err := io.Copy(stdin, session); err != nil {
+		_, err := io.Copy(stdin, op.reader(session))
+		if err != nil && !isClosedPipe(err) {
 			return fmt.Errorf("copy write session to stdin: %w", err)
 		}
 
 		return nil
 	})
 
+	// cmd.Wait closes the pipes once the service exits, so it can only be
+	// called once everything that it wrote has been read.
+	//
+	var outputs sync.WaitGroup
+	outputs.Add(2)
+
 	eg.Go(func() error {
+		defer outputs.Done()
 		defer stdout.Close()
 
-		if _, err := io.Copy(session, stdout); err != nil {
+		if _, err := io.Copy(op.writer(session), stdout); err != nil {
 			return fmt.Errorf("write stdout to session: %w", err)
 		}
 
@@ -210,9 +375,10 @@ func (s *SSHServer) runSessionCmd(ctx context.Context, session ssh.Session) erro
 	})
 
 	eg.Go(func() error {
+		defer outputs.Done()
 		defer stderr.Close()
 
-		if _, err := io.Copy(session.Stderr(), stderr); err != nil {
+		if _, err := io.Copy(op.writer(session.Stderr()), stderr); err != nil {
 			return fmt.Errorf("write stderr to session: %s", err)
 		}
 
@@ -222,11 +388,23 @@ func (s *SSHServer) runSessionCmd(ctx context.Context, session ssh.Session) erro
 	eg.Go(func() error {
 		defer closeAll()
 
-		if err := cmd.Wait(); err != nil {
-			session.Close()
+		outputs.Wait()
+		err := cmd.Wait()
+		close(exited)
+		exitCode = exitCodeFromError(err)
+
+		if err != nil && !isExitError(err) {
+			rejectSession(session, errInternal)
 			return fmt.Errorf("cmd wait: %w", err)
 		}
 
+		// git exiting is what ends the session, regardless of the client
+		// still having its side of the channel open.
+		//
+		if err := exitSession(session, err); err != nil {
+			return fmt.Errorf("session exit: %w", err)
+		}
+
 		return nil
 	})
 
@@ -234,21 +412,165 @@ func (s *SSHServer) runSessionCmd(ctx context.Context, session ssh.Session) erro
 		return fmt.Errorf("errgroup wait: %w", err)
 	}
 
-	if err := session.Exit(exitCodeFromError(err)); err != nil {
-		return fmt.Errorf("session exit: %w", err)
+	return nil
+}
+
+// rejectCommand rejects a session whose git command won't ever get to run,
+// recording it in the access log.
+//
+func (s *SSHServer) rejectCommand(session ssh.Session, command *gitCommand, repository string, identity Identity, err error) {
+	rejectSession(session, err)
+	s.AccessLog.recordRejection(transportSSH, command.Service, repository,
+		identity, session.RemoteAddr().String(), 1,
+	)
+}
+
+// rejectSession lets the client know why its request can't be served and
+// terminates the session with a non-zero exit status.
+//
+func rejectSession(session ssh.Session, err error) {
+	fmt.Fprintf(session.Stderr(), "git-serve: %s\n", err)
+	session.Exit(1)
+}
+
+// sessionGitProtocol is the protocol that the client asked for by setting
+// GIT_PROTOCOL in the session's environment.
+//
+func sessionGitProtocol(session ssh.Session) string {
+	prefix := gitProtocolVariable + "="
+
+	protocol := ""
+	for _, kv := range session.Environ() {
+		if strings.HasPrefix(kv, prefix) {
+			protocol = strings.TrimPrefix(kv, prefix)
+		}
 	}
 
-	return nil
+	return protocol
+}
+
+// sessionCommand is the command to run for the session: the one forced by
+// the authorized key (`command="..."`) if any, or the one the client asked
+// for otherwise.
+//
+func sessionCommand(ctx context.Context, session ssh.Session) string {
+	if key := authorizedKeyFrom(ctx); key != nil && key.Command != "" {
+		return key.Command
+	}
+
+	return session.RawCommand()
+}
+
+// sessionIdentity is the identity of the client as established by the key
+// that it authenticated with (anonymous if auth is disabled).
+//
+func sessionIdentity(ctx context.Context) Identity {
+	key := authorizedKeyFrom(ctx)
+	if key == nil {
+		return Identity{}
+	}
+
+	return Identity{
+		Name:        key.Name,
+		Fingerprint: gossh.FingerprintSHA256(key.Key),
+	}
 }
 
+// isAuthz tells whether `key` may be used to authenticate.
+//
+// As clients can ask about keys without ever proving that they hold them,
+// nothing about the key is kept from here: see authenticatedKey.
+//
 func (s *SSHServer) isAuthz(ctx ssh.Context, key ssh.PublicKey) bool {
-	for _, authorizedKey := range s.authorizedKeys {
-		if ssh.KeysEqual(key, authorizedKey) {
-			return true
+	ctx.SetValue(authAttemptedCtxKey{}, true)
+
+	return s.matchAuthorizedKey(key, ctx.RemoteAddr()) != nil
+}
+
+// authenticatedKey is the authorized key that the client authenticated
+// with, i.e., the one that it signed with, or nil if that one is no longer
+// authorized (e.g., it's been removed from the file, or it expired).
+//
+// It relies on the public key in the context being the one that signed,
+// which golang.org/x/crypto guarantees since v0.31.0 (CVE-2024-45337) by
+// always calling back with it last.
+//
+func (s *SSHServer) authenticatedKey(ctx context.Context) *authorizedKey {
+	key, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+	if !ok {
+		return nil
+	}
+
+	addr, _ := ctx.Value(ssh.ContextKeyRemoteAddr).(net.Addr)
+	return s.matchAuthorizedKey(key, addr)
+}
+
+func (s *SSHServer) matchAuthorizedKey(key ssh.PublicKey, addr net.Addr) *authorizedKey {
+	for _, authorizedKey := range s.loadAuthorizedKeys() {
+		if !ssh.KeysEqual(key, authorizedKey.Key) {
+			continue
+		}
+
+		if !authorizedKey.Allows(addr, time.Now()) {
+			continue
 		}
+
+		return authorizedKey
 	}
 
-	return false
+	return nil
+}
+
+type authAttemptedCtxKey struct{}
+
+// recordingAuthOutcome wraps a connection so that the outcome of
+// authenticating it gets recorded once it's closed: clients try their keys
+// one after another (and those that they hold the private key for, twice)
+// within the same connection, so recording each would count a single
+// login several times over.
+//
+func recordingAuthOutcome(ctx ssh.Context, conn net.Conn) net.Conn {
+	return &authRecordingConn{Conn: conn, ctx: ctx}
+}
+
+type authRecordingConn struct {
+	net.Conn
+
+	ctx  ssh.Context
+	once sync.Once
+}
+
+func (c *authRecordingConn) Close() error {
+	c.once.Do(func() {
+		switch {
+		// the handshake (and thus, authentication) succeeded.
+		case c.ctx.Value(ssh.ContextKeyConn) != nil:
+			recordAuthAttempt(transportSSH, authOutcomeAuthenticated)
+		case c.ctx.Value(authAttemptedCtxKey{}) != nil:
+			recordAuthAttempt(transportSSH, authOutcomeUnauthenticated)
+		}
+	})
+
+	return c.Conn.Close()
+}
+
+func (s *SSHServer) isPtyAllowed(ctx ssh.Context, pty ssh.Pty) bool {
+	if key := s.authenticatedKey(ctx); key == nil || key.NoPTY {
+		return false
+	}
+
+	return true
+}
+
+type authorizedKeyCtxKey struct{}
+
+func withAuthorizedKey(ctx context.Context, key *authorizedKey) context.Context {
+	return context.WithValue(ctx, authorizedKeyCtxKey{}, key)
+}
+
+func authorizedKeyFrom(ctx context.Context) *authorizedKey {
+	key, _ := ctx.Value(authorizedKeyCtxKey{}).(*authorizedKey)
+	return key
 }
 
 func exitCodeFromError(err error) int {
@@ -256,6 +578,11 @@ func exitCodeFromError(err error) int {
 		return 0
 	}
 
+	var serviceErr *exitError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.code
+	}
+
 	exitErr, ok := err.(*exec.ExitError)
 	if !ok {
 		return 1
@@ -272,5 +599,12 @@ func exitCodeFromError(err error) int {
 		return 1
 	}
 
+	// like shells do, those killed by a signal are reported as 128 + the
+	// signal number.
+	//
+	if waitStatus.Signaled() {
+		return 128 + int(waitStatus.Signal())
+	}
+
 	return waitStatus.ExitStatus()
 }
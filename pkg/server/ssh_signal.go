@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// sshSignals maps the signal names of the ssh protocol (RFC 4254, section
+// 6.10) to the signals they stand for.
+//
+var sshSignals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGABRT: syscall.SIGABRT,
+	ssh.SIGALRM: syscall.SIGALRM,
+	ssh.SIGFPE:  syscall.SIGFPE,
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGILL:  syscall.SIGILL,
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGPIPE: syscall.SIGPIPE,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGSEGV: syscall.SIGSEGV,
+	ssh.SIGTERM: syscall.SIGTERM,
+	ssh.SIGUSR1: syscall.SIGUSR1,
+	ssh.SIGUSR2: syscall.SIGUSR2,
+}
+
+// exitSignalMsg is the payload of an `exit-signal` request.
+//
+type exitSignalMsg struct {
+	Signal     string
+	CoreDumped bool
+	Error      string
+	Lang       string
+}
+
+// relaySignals delivers the signals that the client sends over the session
+// (`signal` requests) with `signal` until the returned function is called.
+//
+func relaySignals(session ssh.Session, signal func(syscall.Signal)) func() {
+	signals := make(chan ssh.Signal, 1)
+	done := make(chan struct{})
+
+	session.Signals(signals)
+
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig, ok := sshSignals[sig]; ok {
+					signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		// deregistering has to happen while signals are still being
+		// received, as the session holds a lock while sending them.
+		//
+		session.Signals(nil)
+		close(done)
+	}
+}
+
+// exitSession lets the client know how git exited - with an `exit-status`
+// request, or `exit-signal` if it got killed by a signal - and closes the
+// session.
+//
+func exitSession(session ssh.Session, err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		waitStatus, ok := exitErr.Sys().(syscall.WaitStatus)
+		if ok && waitStatus.Signaled() {
+			_, err := session.SendRequest("exit-signal", false,
+				gossh.Marshal(&exitSignalMsg{
+					Signal:     sshSignalName(waitStatus.Signal()),
+					CoreDumped: waitStatus.CoreDump(),
+				}),
+			)
+			if err != nil {
+				return err
+			}
+
+			return session.Close()
+		}
+	}
+
+	return session.Exit(exitCodeFromError(err))
+}
+
+// sshSignalName is the name that the ssh protocol gives to `sig`, falling
+// back to its number for those that it doesn't name.
+//
+func sshSignalName(sig syscall.Signal) string {
+	for name, signal := range sshSignals {
+		if signal == sig {
+			return string(name)
+		}
+	}
+
+	return sig.String()
+}
+
+// isClosedPipe tells whether `err` comes from writing to a pipe that git
+// stopped reading from, as it does when exiting before consuming all that
+// the client sent (e.g., rejecting a push).
+//
+func isClosedPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, os.ErrClosed) ||
+		errors.Is(err, io.ErrClosedPipe)
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+// querySigner asks whether a public key is acceptable without ever
+// signing with it: its signatures are in a format that servers turn down
+// without tearing the connection down, so that the client moves on to its
+// next key.
+//
+type querySigner struct {
+	gossh.Signer
+}
+
+func (s querySigner) Sign(io.Reader, []byte) (*gossh.Signature, error) {
+	return &gossh.Signature{Format: "unsigned"}, nil
+}
+
+func newTestSigner(t *testing.T) gossh.Signer {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %s", err)
+	}
+
+	signer, err := gossh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatalf("new signer: %s", err)
+	}
+
+	return signer
+}
+
+func TestSSHServerIdentifiesTheKeyThatSigned(t *testing.T) {
+	victim, attacker := newTestSigner(t), newTestSigner(t)
+
+	authorizedKeys := filepath.Join(t.TempDir(), "authorized_keys")
+	err := os.WriteFile(authorizedKeys, append(
+		append([]byte(`environment="GIT_SERVE_IDENTITY=victim" `),
+			gossh.MarshalAuthorizedKey(victim.PublicKey())...),
+		append([]byte(`environment="GIT_SERVE_IDENTITY=attacker" `),
+			gossh.MarshalAuthorizedKey(attacker.PublicKey())...)...,
+	), 0600)
+	if err != nil {
+		t.Fatalf("write authorized keys: %s", err)
+	}
+
+	s := &SSHServer{
+		AuthorizedKeysFilepath: authorizedKeys,
+		logger:                 log.From(context.Background()),
+	}
+
+	server, err := s.server()
+	if err != nil {
+		t.Fatalf("server: %s", err)
+	}
+
+	server.Handler = func(session ssh.Session) {
+		key := s.authenticatedKey(session.Context())
+		if key == nil {
+			session.Exit(1)
+			return
+		}
+
+		io.WriteString(session, key.Identity())
+		session.Exit(0)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	go server.Serve(listener)
+	defer server.Close()
+
+	// ask about the attacker's and the victim's keys, but only sign with
+	// the attacker's.
+	client, err := gossh.Dial("tcp", listener.Addr().String(), &gossh.ClientConfig{
+		User: "git",
+		Auth: []gossh.AuthMethod{gossh.PublicKeys(
+			querySigner{attacker}, querySigner{victim}, attacker,
+		)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("new session: %s", err)
+	}
+	defer session.Close()
+
+	identity, err := session.Output("whoami")
+	if err != nil {
+		t.Fatalf("run: %s", err)
+	}
+
+	if string(identity) != "attacker" {
+		t.Fatalf("expected to be identified as 'attacker', got '%s'", identity)
+	}
+}
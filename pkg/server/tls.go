@@ -0,0 +1,226 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+// selfSignedValidity is for how long certificates self-signed at startup
+// are valid.
+//
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// tlsEnabled tells whether the server should terminate TLS itself.
+//
+func (s *HTTPServer) tlsEnabled() bool {
+	return s.TLSCertFilepath != "" || s.TLSKeyFilepath != "" || s.TLSSelfSigned
+}
+
+// tlsConfig builds the TLS configuration for the server, setting up the
+// watchers that keep the certificate up to date with the files it comes
+// from (if not self-signed), and the pool of CAs that client certificates
+// are verified against (if any).
+//
+func (s *HTTPServer) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: s.getCertificate,
+	}
+
+	switch {
+	case s.TLSSelfSigned:
+		if s.TLSCertFilepath != "" || s.TLSKeyFilepath != "" {
+			return nil, fmt.Errorf("self-signed certificate can't be " +
+				"used together with a certificate and key")
+		}
+
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("self-signed certificate: %w", err)
+		}
+
+		s.certificate.Store(cert)
+		s.logger.WithField("fingerprint", certificateFingerprint(cert.Leaf)).
+			Info("generated self-signed certificate")
+
+	case s.TLSCertFilepath == "" || s.TLSKeyFilepath == "":
+		return nil, fmt.Errorf("both certificate and key must be provided")
+
+	default:
+		for _, fpath := range []string{s.TLSCertFilepath, s.TLSKeyFilepath} {
+			watcher := &fileWatcher{
+				Filepath: fpath,
+				OnChange: s.reloadCertificate,
+			}
+
+			if err := watcher.Load(); err != nil {
+				return nil, fmt.Errorf("load certificate: %w", err)
+			}
+
+			s.watchers = append(s.watchers, watcher)
+		}
+	}
+
+	if s.TLSClientCAFilepath != "" {
+		content, err := os.ReadFile(s.TLSClientCAFilepath)
+		if err != nil {
+			return nil, fmt.Errorf("read file '%s': %w",
+				s.TLSClientCAFilepath, err,
+			)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificates found in '%s'",
+				s.TLSClientCAFilepath,
+			)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.TLSRequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if s.TLSRequireClientCert {
+		return nil, fmt.Errorf("requiring client certificates needs a " +
+			"client CA to verify them against")
+	}
+
+	return config, nil
+}
+
+// reloadCertificate loads the certificate and key pair, swapping the one
+// served to new connections by it.
+//
+// As the certificate and the key are watched independently, a reload might
+// see a new certificate with an old key - that fails without replacing the
+// current pair, being retried once the watcher of the other file notices
+// that it changed too.
+//
+func (s *HTTPServer) reloadCertificate([]byte) error {
+	cert, err := tls.LoadX509KeyPair(s.TLSCertFilepath, s.TLSKeyFilepath)
+	if err != nil {
+		return fmt.Errorf("load x509 key pair: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("parse certificate: %w", err)
+	}
+
+	cert.Leaf = leaf
+	s.certificate.Store(&cert)
+
+	s.logger.WithFields(log.Fields{
+		"subject":     leaf.Subject.String(),
+		"not-after":   leaf.NotAfter,
+		"fingerprint": certificateFingerprint(leaf),
+	}).Info("loaded certificate")
+
+	return nil
+}
+
+func (s *HTTPServer) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := s.certificate.Load().(*tls.Certificate)
+	if cert == nil {
+		return nil, fmt.Errorf("no certificate loaded")
+	}
+
+	return cert, nil
+}
+
+// clientCertificateIdentity determines the identity of a client from the
+// certificate it presented, if verified against the client CAs: the
+// certificate's common name.
+//
+func clientCertificateIdentity(r *http.Request) (Identity, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return Identity{}, false
+	}
+
+	leaf := r.TLS.VerifiedChains[0][0]
+	if leaf.Subject.CommonName == "" {
+		return Identity{}, false
+	}
+
+	return Identity{
+		Name:        leaf.Subject.CommonName,
+		Fingerprint: certificateFingerprint(leaf),
+	}, true
+}
+
+// selfSignedCertificate generates a certificate for `localhost` (and the
+// machine's hostname), for when there's none to serve.
+//
+func selfSignedCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("serial number: %w", err)
+	}
+
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname)
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "git-serve"},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate: %w", err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// certificateFingerprint is the SHA256 digest of the certificate in the
+// same format as `openssl x509 -fingerprint -sha256` (`AB:CD:...`).
+//
+func certificateFingerprint(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.Raw)
+
+	parts := make([]string, len(digest))
+	for idx, b := range digest {
+		parts[idx] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// TokenPrefix prefixes every token generated, making them easy to spot
+// (e.g., by secret scanners).
+//
+const TokenPrefix = "gs_"
+
+// Token is a personal access token that clients can authenticate with over
+// HTTP, either as `Authorization: Bearer <token>` or as the password of
+// basic auth (with any username).
+//
+// Only a digest of the token is kept, so that the file holding them can't
+// be used to authenticate.
+//
+type Token struct {
+	// Name identifies the token, being the identity that clients
+	// authenticating with it get.
+	//
+	Name string `json:"name"`
+
+	// Digest is the hex-encoded SHA256 of the token.
+	//
+	Digest string `json:"digest"`
+
+	// Scopes are the kinds of access (read and/or write) that the token
+	// grants.
+	//
+	Scopes []Access `json:"scopes"`
+
+	// Repositories, if set, restricts the token to repositories matching
+	// any of these globs (as in `path.Match`).
+	//
+	Repositories []string `json:"repositories,omitempty"`
+
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Allows tells whether the token grants `access` to the repository named
+// `repo`.
+//
+func (t *Token) Allows(repo string, access Access) bool {
+	scoped := false
+	for _, scope := range t.Scopes {
+		if scope.includes(access) {
+			scoped = true
+			break
+		}
+	}
+
+	if !scoped {
+		return false
+	}
+
+	if len(t.Repositories) == 0 {
+		return true
+	}
+
+	for _, pattern := range t.Repositories {
+		if matched, _ := path.Match(pattern, repo); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsExpired tells whether the token can no longer be used at time `now`.
+//
+func (t *Token) IsExpired(now time.Time) bool {
+	return t.ExpiresAt != nil && now.After(*t.ExpiresAt)
+}
+
+// Tokens is the set of tokens stored in a tokens file.
+//
+type Tokens struct {
+	Tokens []*Token `json:"tokens"`
+}
+
+// ParseTokens parses the contents of a tokens file.
+//
+func ParseTokens(content []byte) (*Tokens, error) {
+	tokens := &Tokens{}
+	if err := json.Unmarshal(content, tokens); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	for _, token := range tokens.Tokens {
+		for _, scope := range token.Scopes {
+			switch scope {
+			case AccessRead, AccessWrite:
+			default:
+				return nil, fmt.Errorf("token '%s': unknown scope '%s'",
+					token.Name, scope,
+				)
+			}
+		}
+	}
+
+	return tokens, nil
+}
+
+// LoadTokens reads the tokens file at `fpath`, with a missing file being
+// the same as one with no tokens.
+//
+func LoadTokens(fpath string) (*Tokens, error) {
+	content, err := os.ReadFile(fpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &Tokens{}, nil
+		}
+
+		return nil, fmt.Errorf("read file '%s': %w", fpath, err)
+	}
+
+	return ParseTokens(content)
+}
+
+// Save atomically replaces the tokens file at `fpath` with the tokens.
+//
+func (t *Tokens) Save(fpath string) error {
+	content, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(fpath), ".tokens-")
+	if err != nil {
+		return fmt.Errorf("create temp: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(append(content, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("write '%s': %w", f.Name(), err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close '%s': %w", f.Name(), err)
+	}
+
+	if err := os.Rename(f.Name(), fpath); err != nil {
+		return fmt.Errorf("rename '%s': %w", f.Name(), err)
+	}
+
+	return nil
+}
+
+// Create generates a new token, returning it in the clear - the only time
+// it's ever available as such.
+//
+func (t *Tokens) Create(name string, scopes []Access, repositories []string, expiresAt *time.Time) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("name must be provided")
+	}
+
+	for _, token := range t.Tokens {
+		if token.Name == name {
+			return "", fmt.Errorf("token '%s' already exists", name)
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("rand read: %w", err)
+	}
+
+	secret := TokenPrefix + hex.EncodeToString(buf)
+
+	t.Tokens = append(t.Tokens, &Token{
+		Name:         name,
+		Digest:       tokenDigest(secret),
+		Scopes:       scopes,
+		Repositories: repositories,
+		CreatedAt:    time.Now().UTC(),
+		ExpiresAt:    expiresAt,
+	})
+
+	return secret, nil
+}
+
+// Revoke removes the token named `name`, telling whether it existed.
+//
+func (t *Tokens) Revoke(name string) bool {
+	for idx, token := range t.Tokens {
+		if token.Name == name {
+			t.Tokens = append(t.Tokens[:idx], t.Tokens[idx+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Lookup finds the token that `secret` corresponds to, as long as it hasn't
+// expired by `now`.
+//
+func (t *Tokens) Lookup(secret string, now time.Time) *Token {
+	digest := []byte(tokenDigest(secret))
+
+	for _, token := range t.Tokens {
+		if subtle.ConstantTimeCompare(digest, []byte(token.Digest)) != 1 {
+			continue
+		}
+
+		if token.IsExpired(now) {
+			return nil
+		}
+
+		return token
+	}
+
+	return nil
+}
+
+// names lists the names of the tokens.
+//
+func (t *Tokens) names() []string {
+	names := make([]string, 0, len(t.Tokens))
+	for _, token := range t.Tokens {
+		names = append(names, token.Name)
+	}
+
+	return names
+}
+
+func tokenDigest(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokensLookup(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	yesterday, tomorrow := now.AddDate(0, 0, -1), now.AddDate(0, 0, 1)
+
+	tokens := &Tokens{}
+
+	ci, err := tokens.Create("ci", []Access{AccessRead}, nil, &tomorrow)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+
+	expired, err := tokens.Create("expired", []Access{AccessWrite}, nil, &yesterday)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+
+	revoked, err := tokens.Create("revoked", []Access{AccessWrite}, nil, nil)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+
+	if !strings.HasPrefix(ci, TokenPrefix) {
+		t.Errorf("expected token to be prefixed with '%s', got '%s'", TokenPrefix, ci)
+	}
+
+	if _, err := tokens.Create("ci", []Access{AccessRead}, nil, nil); err == nil {
+		t.Errorf("expected creating a token with a taken name to fail")
+	}
+
+	if !tokens.Revoke("revoked") || tokens.Revoke("revoked") {
+		t.Fatalf("expected the token to be revoked exactly once")
+	}
+
+	if token := tokens.Lookup(ci, now); token == nil || token.Name != "ci" {
+		t.Errorf("expected to find ci's token, got %+v", token)
+	}
+
+	for name, secret := range map[string]string{
+		"expired": expired,
+		"revoked": revoked,
+		"unknown": TokenPrefix + "0123",
+		"empty":   "",
+		"digest":  tokens.Tokens[0].Digest,
+	} {
+		if token := tokens.Lookup(secret, now); token != nil {
+			t.Errorf("%s: expected no token, got %+v", name, token)
+		}
+	}
+
+	if token := tokens.Lookup(ci, tomorrow.Add(time.Second)); token != nil {
+		t.Errorf("expected ci's token to expire, got %+v", token)
+	}
+}
+
+func TestTokenAllows(t *testing.T) {
+	read := &Token{Scopes: []Access{AccessRead}, Repositories: []string{"team/*"}}
+	write := &Token{Scopes: []Access{AccessWrite}}
+
+	for _, tc := range []struct {
+		token   *Token
+		repo    string
+		access  Access
+		allowed bool
+	}{
+		{read, "team/foo.git", AccessRead, true},
+		{read, "team/foo.git", AccessWrite, false},
+		{read, "other/foo.git", AccessRead, false},
+		{read, "team/sub/foo.git", AccessRead, false},
+		{read, "team.git", AccessRead, false},
+
+		{write, "anything.git", AccessRead, true},
+		{write, "team/sub/foo.git", AccessWrite, true},
+
+		{&Token{}, "foo.git", AccessRead, false},
+	} {
+		if allowed := tc.token.Allows(tc.repo, tc.access); allowed != tc.allowed {
+			t.Errorf("%+v: Allows(%s, %s): expected %t, got %t",
+				tc.token, tc.repo, tc.access, tc.allowed, allowed,
+			)
+		}
+	}
+}
+
+func TestTokensSaveLoad(t *testing.T) {
+	fpath := filepath.Join(t.TempDir(), "tokens.json")
+
+	tokens, err := LoadTokens(fpath)
+	if err != nil {
+		t.Fatalf("load missing file: %s", err)
+	}
+
+	if len(tokens.Tokens) != 0 {
+		t.Fatalf("expected no tokens from a missing file, got %d", len(tokens.Tokens))
+	}
+
+	secret, err := tokens.Create("ci", []Access{AccessRead}, []string{"team/*"}, nil)
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+
+	if err := tokens.Save(fpath); err != nil {
+		t.Fatalf("save: %s", err)
+	}
+
+	loaded, err := LoadTokens(fpath)
+	if err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	token := loaded.Lookup(secret, time.Now())
+	if token == nil {
+		t.Fatal("expected to find the token after loading it back")
+	}
+
+	if strings.Contains(token.Digest, secret) {
+		t.Errorf("expected the token to not be stored in the clear")
+	}
+
+	if !token.Allows("team/foo.git", AccessRead) || token.Allows("team/foo.git", AccessWrite) {
+		t.Errorf("expected scopes and repositories to be kept, got %+v", token)
+	}
+}
+
+func TestParseTokensUnknownScope(t *testing.T) {
+	_, err := ParseTokens([]byte(`{"tokens": [{"name": "ci", "digest": "00", "scopes": ["admin"]}]}`))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+// DefaultWatchInterval is how often files that can be reloaded at runtime
+// (authorized keys, credentials, etc) are checked for changes.
+//
+const DefaultWatchInterval = 5 * time.Second
+
+// fileWatcher keeps track of the contents of a file, handing them to
+// OnChange whenever they change - either noticed through polling (which
+// plays well with the symlink swaps that Kubernetes does for projected
+// volumes) or forced by a SIGHUP.
+//
+type fileWatcher struct {
+	Filepath string
+	Interval time.Duration
+	OnChange func(content []byte) error
+
+	checksum [sha256.Size]byte
+}
+
+// Load reads the file and, if its contents differ from the last ones seen,
+// hands them to OnChange.
+//
+func (w *fileWatcher) Load() error {
+	content, err := os.ReadFile(w.Filepath)
+	if err != nil {
+		return fmt.Errorf("read file '%s': %w", w.Filepath, err)
+	}
+
+	checksum := sha256.Sum256(content)
+	if checksum == w.checksum {
+		return nil
+	}
+
+	if err := w.OnChange(content); err != nil {
+		return err
+	}
+
+	w.checksum = checksum
+	return nil
+}
+
+// Run reloads the file every interval or on SIGHUP until the context is
+// cancelled. Failures are logged, leaving what was loaded before in place.
+//
+func (w *fileWatcher) Run(ctx context.Context) {
+	logger := log.From(ctx).WithField("file", w.Filepath)
+
+	interval := w.Interval
+	if interval == 0 {
+		interval = DefaultWatchInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-hupCh:
+			logger.Info("sighup received - reloading")
+		}
+
+		if err := w.Load(); err != nil {
+			logger.WithError(err).Error("reload")
+		}
+	}
+}
@@ -0,0 +1,698 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/cirocosta/git-serve/pkg/log"
+)
+
+const (
+	// webhookMaxAttempts is how many times a delivery is attempted before
+	// being given up on.
+	//
+	webhookMaxAttempts = 8
+
+	// webhookMaxBackoff caps how long to wait between attempts.
+	//
+	webhookMaxBackoff = time.Hour
+
+	// webhookTimeout is how long a single attempt can take.
+	//
+	webhookTimeout = 10 * time.Second
+
+	// webhookMaxDeliveries is how many finished (delivered or failed)
+	// deliveries are kept around for inspection.
+	//
+	webhookMaxDeliveries = 500
+)
+
+// WebhooksConfig lists the endpoints that get notified of pushes.
+//
+// ```yaml
+// webhooks:
+//   - url: https://ci.example.com/hooks/git
+//     secret: s3cr3t
+//     repositories: ["team/*"]
+// ```
+//
+type WebhooksConfig struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// Webhook is an endpoint that push events are POSTed to.
+//
+type Webhook struct {
+	// URL is where the events are POSTed to.
+	//
+	URL string `json:"url"`
+
+	// Secret, if set, is the key with which payloads are signed
+	// (HMAC-SHA256, in the `X-Hub-Signature-256` header).
+	//
+	Secret string `json:"secret,omitempty"`
+
+	// Repositories, if set, restricts the events to pushes to repositories
+	// matching any of these globs (as in `path.Match`).
+	//
+	Repositories []string `json:"repositories,omitempty"`
+}
+
+func (w Webhook) matchesRepository(repo string) bool {
+	if len(w.Repositories) == 0 {
+		return true
+	}
+
+	for _, pattern := range w.Repositories {
+		if matched, _ := path.Match(pattern, repo); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseWebhooksConfig parses the webhooks configuration in either YAML or
+// JSON.
+//
+func ParseWebhooksConfig(content []byte) (*WebhooksConfig, error) {
+	config := &WebhooksConfig{}
+	if err := yaml.UnmarshalStrict(content, config); err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+
+	for idx, webhook := range config.Webhooks {
+		if !strings.HasPrefix(webhook.URL, "http://") &&
+			!strings.HasPrefix(webhook.URL, "https://") {
+			return nil, fmt.Errorf("webhook %d: url must be http(s)", idx)
+		}
+
+		for _, pattern := range webhook.Repositories {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("webhook %d: pattern '%s': %w",
+					idx, pattern, err,
+				)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// DeliveryStatus is the state that a webhook delivery is in.
+//
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// Delivery is an event to be (or that was) POSTed to a webhook, along with
+// the attempts made at doing so.
+//
+type Delivery struct {
+	ID            string            `json:"id"`
+	Event         string            `json:"event"`
+	URL           string            `json:"url"`
+	Repository    string            `json:"repository"`
+	Payload       json.RawMessage   `json:"payload"`
+	Status        DeliveryStatus    `json:"status"`
+	Attempts      []DeliveryAttempt `json:"attempts"`
+	CreatedAt     time.Time         `json:"createdAt"`
+	NextAttemptAt *time.Time        `json:"nextAttemptAt,omitempty"`
+
+	inflight bool
+}
+
+// DeliveryAttempt is the outcome of POSTing an event once.
+//
+type DeliveryAttempt struct {
+	At         time.Time     `json:"at"`
+	StatusCode int           `json:"statusCode,omitempty"`
+	Error      string        `json:"error,omitempty"`
+	Duration   time.Duration `json:"duration"`
+}
+
+// Notifier POSTs push events to the webhooks in a configuration file
+// (reloaded whenever it changes), retrying failed deliveries with
+// exponential backoff.
+//
+// Deliveries are persisted under StateDirectory (if set) so that pending
+// ones survive restarts, and finished ones can be inspected.
+//
+// A nil Notifier notifies no one.
+//
+type Notifier struct {
+	ConfigFilepath        string
+	GitExecutableFilepath string
+	StateDirectory        string
+
+	// InitialBackoff is how long to wait before retrying a delivery for
+	// the first time, doubling at each subsequent attempt (defaults to
+	// a second).
+	//
+	InitialBackoff time.Duration
+
+	logger     *log.Logger
+	config     atomic.Value // *WebhooksConfig
+	watcher    *fileWatcher
+	client     *http.Client
+	wakeCh     chan struct{}
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+}
+
+// Load loads the configuration for the first time (failing if it can't be
+// parsed) along with the deliveries persisted in the state directory.
+//
+func (n *Notifier) Load(ctx context.Context) error {
+	n.logger = log.From(ctx)
+	n.client = &http.Client{Timeout: webhookTimeout}
+	n.wakeCh = make(chan struct{}, 1)
+	n.deliveries = map[string]*Delivery{}
+
+	if n.InitialBackoff == 0 {
+		n.InitialBackoff = time.Second
+	}
+
+	n.watcher = &fileWatcher{
+		Filepath: n.ConfigFilepath,
+		OnChange: n.setConfig,
+	}
+
+	if err := n.watcher.Load(); err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+
+	if err := n.loadDeliveries(); err != nil {
+		return fmt.Errorf("load deliveries: %w", err)
+	}
+
+	return nil
+}
+
+// Run delivers events as they get queued (and retries those that failed)
+// until the context is cancelled.
+//
+func (n *Notifier) Run(ctx context.Context) error {
+	go n.watcher.Run(ctx)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-n.wakeCh:
+		}
+
+		for _, delivery := range n.dueDeliveries(time.Now()) {
+			wg.Add(1)
+			go func(delivery *Delivery) {
+				defer wg.Done()
+				n.deliver(ctx, delivery)
+			}(delivery)
+		}
+	}
+}
+
+// Deliveries lists, most recent first, the deliveries for the repositories
+// that `filter` accepts.
+//
+func (n *Notifier) Deliveries(filter func(repo string) bool) []Delivery {
+	if n == nil {
+		return []Delivery{}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	deliveries := []Delivery{}
+	for _, delivery := range n.deliveries {
+		if filter(delivery.Repository) {
+			deliveries = append(deliveries, *delivery)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+
+	return deliveries
+}
+
+// pushTracker captures the refs of a repository before a push so that,
+// once it's done, the events for whatever it changed can be queued.
+//
+type pushTracker struct {
+	notifier  *Notifier
+	repo      *repository
+	identity  Identity
+	transport string
+	before    refs
+}
+
+// track starts tracking a push to `repo`, returning nil if there are no
+// webhooks to notify.
+//
+func (n *Notifier) track(repo *repository, identity Identity, transport string) *pushTracker {
+	if n == nil || !n.hasWebhooksFor(repo.Name) {
+		return nil
+	}
+
+	before, err := snapshotRefs(repo.Directory)
+	if err != nil {
+		n.logger.WithError(err).
+			WithField("repository", repo.Name).
+			Error("snapshot refs")
+
+		return nil
+	}
+
+	return &pushTracker{
+		notifier:  n,
+		repo:      repo,
+		identity:  identity,
+		transport: transport,
+		before:    before,
+	}
+}
+
+// done queues an event for each ref that the push updated.
+//
+func (t *pushTracker) done() {
+	if t == nil {
+		return
+	}
+
+	logger := t.notifier.logger.WithField("repository", t.repo.Name)
+
+	after, err := snapshotRefs(t.repo.Directory)
+	if err != nil {
+		logger.WithError(err).Error("snapshot refs")
+		return
+	}
+
+	for _, update := range diffRefs(t.before, after) {
+		event, err := newPushEvent(t.notifier.GitExecutableFilepath, t.repo, t.identity, t.transport, update, t.before)
+		if err != nil {
+			logger.WithError(err).
+				WithField("ref", update.Ref).
+				Error("new push event")
+			continue
+		}
+
+		if err := t.notifier.enqueue("push", t.repo.Name, event); err != nil {
+			logger.WithError(err).
+				WithField("ref", update.Ref).
+				Error("enqueue")
+		}
+	}
+}
+
+func (n *Notifier) hasWebhooksFor(repo string) bool {
+	for _, webhook := range n.loadConfig().Webhooks {
+		if webhook.matchesRepository(repo) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// enqueue creates a delivery of the event for each webhook interested in
+// the repository.
+//
+func (n *Notifier) enqueue(event, repo string, payload interface{}) error {
+	content, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	now := time.Now().UTC()
+	for _, webhook := range n.loadConfig().Webhooks {
+		if !webhook.matchesRepository(repo) {
+			continue
+		}
+
+		id, err := newDeliveryID()
+		if err != nil {
+			return fmt.Errorf("new delivery id: %w", err)
+		}
+
+		delivery := &Delivery{
+			ID:            id,
+			Event:         event,
+			URL:           webhook.URL,
+			Repository:    repo,
+			Payload:       content,
+			Status:        DeliveryPending,
+			Attempts:      []DeliveryAttempt{},
+			CreatedAt:     now,
+			NextAttemptAt: &now,
+		}
+
+		n.mu.Lock()
+		n.deliveries[id] = delivery
+		err = n.saveDelivery(delivery)
+		n.mu.Unlock()
+
+		if err != nil {
+			return fmt.Errorf("save delivery: %w", err)
+		}
+	}
+
+	select {
+	case n.wakeCh <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+func (n *Notifier) dueDeliveries(now time.Time) []*Delivery {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	due := []*Delivery{}
+	for _, delivery := range n.deliveries {
+		if delivery.Status != DeliveryPending ||
+			delivery.inflight ||
+			(delivery.NextAttemptAt != nil && delivery.NextAttemptAt.After(now)) {
+			continue
+		}
+
+		delivery.inflight = true
+		due = append(due, delivery)
+	}
+
+	return due
+}
+
+// deliver makes an attempt at POSTing the delivery's payload, scheduling
+// the next one if it fails (or giving up after webhookMaxAttempts).
+//
+func (n *Notifier) deliver(ctx context.Context, delivery *Delivery) {
+	logger := n.logger.WithFields(log.Fields{
+		"delivery":   delivery.ID,
+		"url":        delivery.URL,
+		"repository": delivery.Repository,
+	})
+
+	attempt := n.post(ctx, delivery)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	delivery.inflight = false
+
+	// interrupted by a shutdown - the attempt is made again on the next
+	// start.
+	if ctx.Err() != nil {
+		return
+	}
+
+	delivery.Attempts = append(delivery.Attempts, attempt)
+
+	switch {
+	case attempt.Error == "":
+		delivery.Status = DeliveryDelivered
+		delivery.NextAttemptAt = nil
+		logger.Info("delivered")
+
+	case len(delivery.Attempts) >= webhookMaxAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.NextAttemptAt = nil
+		logger.WithField("error", attempt.Error).Error("delivery failed")
+
+	default:
+		backoff := n.InitialBackoff << (len(delivery.Attempts) - 1)
+		if backoff > webhookMaxBackoff || backoff <= 0 {
+			backoff = webhookMaxBackoff
+		}
+
+		nextAttemptAt := time.Now().UTC().Add(backoff)
+		delivery.NextAttemptAt = &nextAttemptAt
+		logger.WithFields(log.Fields{
+			"error":   attempt.Error,
+			"attempt": len(delivery.Attempts),
+			"backoff": backoff,
+		}).Warn("delivery attempt failed")
+	}
+
+	if err := n.saveDelivery(delivery); err != nil {
+		logger.WithError(err).Error("save delivery")
+	}
+
+	if delivery.Status != DeliveryPending {
+		n.pruneDeliveries()
+	}
+}
+
+// post POSTs the delivery's payload to its webhook, signing it with the
+// webhook's current secret.
+//
+func (n *Notifier) post(ctx context.Context, delivery *Delivery) DeliveryAttempt {
+	attempt := DeliveryAttempt{At: time.Now().UTC()}
+	defer func() {
+		attempt.Duration = time.Since(attempt.At)
+	}()
+
+	webhook, found := n.webhook(delivery.URL)
+	if !found {
+		attempt.Error = "webhook no longer configured"
+		return attempt
+	}
+
+	req, err := http.NewRequestWithContext(ctx,
+		http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload),
+	)
+	if err != nil {
+		attempt.Error = fmt.Sprintf("new request: %s", err)
+		return attempt
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "git-serve")
+	req.Header.Set("X-GitHub-Event", delivery.Event)
+	req.Header.Set("X-GitHub-Delivery", delivery.ID)
+	if webhook.Secret != "" {
+		req.Header.Set("X-Hub-Signature-256",
+			signPayload(webhook.Secret, delivery.Payload),
+		)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("unexpected status: %s", resp.Status)
+	}
+
+	return attempt
+}
+
+// signPayload computes the signature of a payload in the format of
+// GitHub's `X-Hub-Signature-256` header.
+//
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *Notifier) webhook(url string) (Webhook, bool) {
+	for _, webhook := range n.loadConfig().Webhooks {
+		if webhook.URL == url {
+			return webhook, true
+		}
+	}
+
+	return Webhook{}, false
+}
+
+func (n *Notifier) setConfig(content []byte) error {
+	config, err := ParseWebhooksConfig(content)
+	if err != nil {
+		return fmt.Errorf("parse webhooks config: %w", err)
+	}
+
+	n.config.Store(config)
+	n.logger.WithField("webhooks", len(config.Webhooks)).Info("loaded webhooks")
+
+	return nil
+}
+
+func (n *Notifier) loadConfig() *WebhooksConfig {
+	config, _ := n.config.Load().(*WebhooksConfig)
+	if config == nil {
+		return &WebhooksConfig{}
+	}
+
+	return config
+}
+
+func (n *Notifier) deliveriesDirectory() string {
+	return filepath.Join(n.StateDirectory, "webhooks", "deliveries")
+}
+
+// loadDeliveries reads the deliveries persisted in the state directory.
+//
+func (n *Notifier) loadDeliveries() error {
+	if n.StateDirectory == "" {
+		return nil
+	}
+
+	dir := n.deliveriesDirectory()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir '%s': %w", dir, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read dir '%s': %w", dir, err)
+	}
+
+	pending := 0
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		fpath := filepath.Join(dir, entry.Name())
+
+		content, err := os.ReadFile(fpath)
+		if err != nil {
+			return fmt.Errorf("read file '%s': %w", fpath, err)
+		}
+
+		delivery := &Delivery{}
+		if err := json.Unmarshal(content, delivery); err != nil {
+			n.logger.WithError(err).
+				WithField("file", fpath).
+				Warn("skipping malformed delivery")
+			continue
+		}
+
+		if delivery.Status == DeliveryPending {
+			pending++
+		}
+
+		n.deliveries[delivery.ID] = delivery
+	}
+
+	n.logger.WithFields(log.Fields{
+		"deliveries": len(n.deliveries),
+		"pending":    pending,
+	}).Info("loaded deliveries")
+
+	return nil
+}
+
+// saveDelivery persists the delivery in the state directory (if any).
+// Must be called with the lock held.
+//
+func (n *Notifier) saveDelivery(delivery *Delivery) error {
+	if n.StateDirectory == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("marshal: %w", err)
+	}
+
+	dir := n.deliveriesDirectory()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("mkdir '%s': %w", dir, err)
+	}
+
+	fpath := filepath.Join(dir, delivery.ID+".json")
+	tmp := fpath + ".tmp"
+
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return fmt.Errorf("write file '%s': %w", tmp, err)
+	}
+
+	if err := os.Rename(tmp, fpath); err != nil {
+		return fmt.Errorf("rename '%s': %w", tmp, err)
+	}
+
+	return nil
+}
+
+// pruneDeliveries forgets about the oldest finished deliveries so that no
+// more than webhookMaxDeliveries are kept. Must be called with the lock
+// held.
+//
+func (n *Notifier) pruneDeliveries() {
+	finished := []*Delivery{}
+	for _, delivery := range n.deliveries {
+		if delivery.Status != DeliveryPending {
+			finished = append(finished, delivery)
+		}
+	}
+
+	if len(finished) <= webhookMaxDeliveries {
+		return
+	}
+
+	sort.Slice(finished, func(i, j int) bool {
+		return finished[i].CreatedAt.Before(finished[j].CreatedAt)
+	})
+
+	for _, delivery := range finished[:len(finished)-webhookMaxDeliveries] {
+		delete(n.deliveries, delivery.ID)
+
+		if n.StateDirectory != "" {
+			os.Remove(filepath.Join(n.deliveriesDirectory(), delivery.ID+".json"))
+		}
+	}
+}
+
+// newDeliveryID generates a random (v4) UUID, like GitHub's delivery IDs.
+//
+func newDeliveryID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("rand read: %w", err)
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,43 @@
+#!/usr/bin/env python
+
+# webhook-receiver.py - records the requests it receives as json files in a
+# directory, failing the first few of them.
+#
+# usage: webhook-receiver.py <port> <dir> <failures>
+
+import json
+import os
+import sys
+
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+port, directory, failures = int(sys.argv[1]), sys.argv[2], int(sys.argv[3])
+received = 0
+
+
+class Handler(BaseHTTPRequestHandler):
+    def do_POST(self):
+        global received
+
+        body = self.rfile.read(int(self.headers['Content-Length']))
+        received += 1
+
+        if received <= failures:
+            self.send_response(500)
+            self.end_headers()
+            return
+
+        with open(os.path.join(directory, '%d.json' % received), 'w') as f:
+            json.dump({
+                'headers': {k.lower(): v for k, v in self.headers.items()},
+                'body': body.decode(),
+            }, f)
+
+        self.send_response(204)
+        self.end_headers()
+
+    def log_message(self, *args):
+        pass
+
+
+HTTPServer(('127.0.0.1', port), Handler).serve_forever()